@@ -0,0 +1,282 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/trace"
+)
+
+// BackpressurePolicy decides what happens when a receive buffer (Messages(), a typed
+// subscription channel or a handler queue) is full.
+type BackpressurePolicy int
+
+const (
+	// DropNewest discards the incoming message (default).
+	DropNewest BackpressurePolicy = iota
+	// DropOldest discards the oldest buffered message to make room.
+	DropOldest
+	// Block waits for room. Up to 256 more messages queue in memory while Acks and
+	// replies are still read, so handlers can Publish and Reply; beyond that the relay
+	// connection stops being read and QUIC flow control pushes back on the relay
+	// instead of losing messages.
+	Block
+	// SpillToDisk queues overflow for Messages() in a file under Config.SpillDir and
+	// delivers it in order once the reader catches up. Typed channels and handler
+	// queues block instead. The file holds the decrypted messages (payload and sealed
+	// headers) in plaintext: it is created with mode 0600 and removed on Close, but
+	// Config.SpillDir must be a directory only this process's user can read, ideally
+	// on an encrypted volume.
+	SpillToDisk
+)
+
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	case SpillToDisk:
+		return "spill"
+	}
+	return "unknown"
+}
+
+// DefaultSpillMaxBytes caps the spilled messages when Config.SpillMaxBytes is 0.
+const DefaultSpillMaxBytes = 64 << 20
+
+// errSpillFull is returned when the spilled messages reached their size limit
+var errSpillFull = errors.New("spill file full")
+
+// errNoSpillDir is returned by New for SpillToDisk without Config.SpillDir
+var errNoSpillDir = errors.New("SpillToDisk needs Config.SpillDir (spilled messages are plaintext)")
+
+// spillCompactMin is how much delivered data the spill file may hold at its start
+// before it is compacted
+const spillCompactMin = 1 << 20
+
+// Dropped returns the number of received messages discarded by the backpressure
+// policy (or because a spill file was full) since New.
+func (c *Client) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// drop counts m as dropped and reports it to Config.OnDrop
+func (c *Client) drop(m ReceivedMessage) {
+	c.dropped.Add(1)
+	if c.onDrop != nil {
+		c.onDrop(m)
+	}
+}
+
+// deliver puts m on Messages() according to the client's policy
+func (c *Client) deliver(m ReceivedMessage) {
+	if c.spill == nil {
+		offer(c.msgs, m, c.policy, c.done, c.drop)
+		return
+	}
+	// keep order: once something is spilled, everything queues behind it
+	if !c.spill.busy() {
+		select {
+		case c.msgs <- m:
+			return
+		default:
+		}
+	}
+	if err := c.spill.push(m); err != nil {
+		slog.Debug("client: spill failed", "topic", m.Topic, "err", err)
+		c.drop(m)
+	}
+}
+
+// offer delivers m on ch according to policy; dropped messages (m itself or, for
+// DropOldest, the oldest buffered one) go to onDrop. done aborts a blocking send.
+func offer[T any](ch chan T, m T, policy BackpressurePolicy, done <-chan struct{}, onDrop func(T)) {
+	switch policy {
+	case Block, SpillToDisk:
+		select {
+		case ch <- m:
+		case <-done:
+			onDrop(m)
+		}
+	case DropOldest:
+		for {
+			select {
+			case ch <- m:
+				return
+			default:
+			}
+			select {
+			case old := <-ch:
+				onDrop(old)
+			default:
+			}
+		}
+	default:
+		select {
+		case ch <- m:
+		default:
+			onDrop(m)
+		}
+	}
+}
+
+// spool is a file FIFO of messages waiting for room in Messages(). A pump goroutine
+// moves them to the channel in order. Records are appended at writeOff and read at
+// readOff; once the delivered head of the file outgrows the rest, the rest is moved
+// to the start, so the file stays within about twice maxBytes.
+type spool struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	f        *os.File
+	readOff  int64
+	writeOff int64
+	pending  int // records written and not yet delivered (including the one in flight)
+	maxBytes int64
+	closed   bool
+	done     chan struct{} // closed when the pump exits
+}
+
+func newSpool(dir string, maxBytes int64) (*spool, error) {
+	f, err := os.CreateTemp(dir, "qumbed-spill-*") // mode 0600
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultSpillMaxBytes
+	}
+	s := &spool{f: f, maxBytes: maxBytes, done: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+// busy reports whether messages are waiting, so new ones must queue behind them
+func (s *spool) busy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending > 0
+}
+
+// spillRecord is a spooled message. Its trace context is unexported, so json.Marshal
+// would drop it; the record keeps it as a traceparent.
+type spillRecord struct {
+	ReceivedMessage
+	Traceparent string `json:"traceparent,omitempty"`
+}
+
+func (s *spool) push(m ReceivedMessage) error {
+	data, err := json.Marshal(spillRecord{m, m.trace.Traceparent()})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	// only what is still waiting counts, not the delivered head of the file
+	if s.writeOff-s.readOff+int64(len(data))+4 > s.maxBytes {
+		return errSpillFull
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(data)))
+	if _, err := s.f.WriteAt(append(hdr[:], data...), s.writeOff); err != nil {
+		return err
+	}
+	s.writeOff += int64(len(data)) + 4
+	s.pending++
+	s.cond.Signal()
+	return nil
+}
+
+// next blocks until a record is available and returns it without removing it
+func (s *spool) next() (ReceivedMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.readOff == s.writeOff && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return ReceivedMessage{}, false
+	}
+	var hdr [4]byte
+	if _, err := s.f.ReadAt(hdr[:], s.readOff); err != nil {
+		return ReceivedMessage{}, false
+	}
+	data := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := s.f.ReadAt(data, s.readOff+4); err != nil && err != io.EOF {
+		return ReceivedMessage{}, false
+	}
+	s.readOff += int64(len(data)) + 4
+	var rec spillRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return ReceivedMessage{}, false
+	}
+	m := rec.ReceivedMessage
+	m.trace, _ = trace.ParseTraceparent(rec.Traceparent)
+	return m, true
+}
+
+// delivered marks the record returned by next as handed off
+func (s *spool) delivered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	if s.pending == 0 && s.readOff == s.writeOff {
+		// everything delivered: reuse the file from the start
+		s.readOff, s.writeOff = 0, 0
+		_ = s.f.Truncate(0)
+		return
+	}
+	if rest := s.writeOff - s.readOff; s.readOff >= spillCompactMin && rest <= s.readOff {
+		if err := s.compact(rest); err != nil {
+			slog.Warn("client: compacting spill file failed", "err", err)
+		}
+	}
+}
+
+// compact moves the rest bytes not yet read to the start of the file. They do not
+// overlap their new place, as rest <= readOff. s.mu is held.
+func (s *spool) compact(rest int64) error {
+	src := io.NewSectionReader(s.f, s.readOff, rest)
+	if _, err := io.Copy(io.NewOffsetWriter(s.f, 0), src); err != nil {
+		return err
+	}
+	s.readOff, s.writeOff = 0, rest
+	return s.f.Truncate(rest)
+}
+
+// pump moves spooled messages to ch until the spool is closed
+func (s *spool) pump(ch chan ReceivedMessage, closing <-chan struct{}) {
+	defer close(s.done)
+	for {
+		m, ok := s.next()
+		if !ok {
+			return
+		}
+		select {
+		case ch <- m:
+			s.delivered()
+		case <-closing:
+			return
+		}
+	}
+}
+
+func (s *spool) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+	name := s.f.Name()
+	s.f.Close()
+	os.Remove(name)
+}
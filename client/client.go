@@ -4,12 +4,17 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
 	"github.com/SWAI-Ltd/Qumbed/internal/mesh"
 	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+	"github.com/SWAI-Ltd/Qumbed/internal/trace"
 )
 
 const (
@@ -20,10 +25,106 @@ const (
 // ErrClosed is returned when using a client after Close.
 var ErrClosed = errors.New("client closed")
 
+// ErrNoReplyTo is returned by Reply for a message that was not sent with Request.
+var ErrNoReplyTo = mesh.ErrNoReplyTo
+
+// RelayError is an Error frame from the relay, returned by Publish, Subscribe and
+// Request. For Code "RATE_LIMITED", RetryAfter says when to try again.
+type RelayError = mesh.RelayError
+
 // ReceivedMessage is a message delivered to the subscriber.
 type ReceivedMessage struct {
 	Topic   string
 	Payload []byte
+	// SchemaID is the publisher's schema ID (may be a newer compatible version than subscribed).
+	SchemaID string
+	// Encoding of Payload; empty means JSON. Use Client.Unmarshal to decode either encoding.
+	Encoding Encoding
+	// Retained is true for the topic's last retained value, replayed by the relay on Subscribe.
+	Retained bool
+	// Sender is the publisher's public key; nil for messages generated by the relay (presence).
+	Sender *[crypto.PublicKeySize]byte
+	// ReplyTo is set when the message is a request; answer it with Client.Reply.
+	ReplyTo string
+	// CorrelationID matches a reply to its request.
+	CorrelationID string
+	// Headers were sealed with the payload by the publisher (see WithHeader).
+	Headers map[string]string
+	// RoutingHeaders were sent in cleartext, visible to the relay (see WithRoutingHeader).
+	RoutingHeaders map[string]string
+
+	trace trace.SpanContext // receive span, see TraceContext
+}
+
+// Encoding is a payload encoding (re-export from proto).
+type Encoding = proto.Encoding
+
+// Payload encodings.
+const (
+	EncodingJSON     = proto.EncodingJSON
+	EncodingProtobuf = proto.EncodingProtobuf
+)
+
+// PublishOption configures a single Publish call.
+type PublishOption func(*mesh.PublishOptions)
+
+// WithEncoding sends the payload in enc. For EncodingProtobuf the payload must be the
+// protobuf binary form and the schema must have a descriptor (the built-ins do).
+func WithEncoding(enc Encoding) PublishOption {
+	return func(o *mesh.PublishOptions) { o.Encoding = enc }
+}
+
+// WithRetain asks the relay to keep the message as the topic's last value and deliver
+// it to future subscribers as soon as they subscribe. See Client.ClearRetained.
+func WithRetain() PublishOption {
+	return func(o *mesh.PublishOptions) { o.Retain = true }
+}
+
+// Well-known header names (see WithHeader).
+const (
+	HeaderContentType = proto.HeaderContentType
+	HeaderTimestamp   = proto.HeaderTimestamp
+)
+
+// WithHeader adds a header sealed together with the payload: only the recipient can
+// read it (ReceivedMessage.Headers). Use it for content type, trace IDs, timestamps or
+// application properties.
+func WithHeader(key, value string) PublishOption {
+	return func(o *mesh.PublishOptions) {
+		if o.Headers == nil {
+			o.Headers = make(map[string]string)
+		}
+		o.Headers[key] = value
+	}
+}
+
+// WithRoutingHeader adds a cleartext header the relay can see and forward
+// (ReceivedMessage.RoutingHeaders). Keep them few and small: at most 16 headers and
+// 1 KiB in total. Do not put anything secret in them.
+func WithRoutingHeader(key, value string) PublishOption {
+	return func(o *mesh.PublishOptions) {
+		if o.RoutingHeaders == nil {
+			o.RoutingHeaders = make(map[string]string)
+		}
+		o.RoutingHeaders[key] = value
+	}
+}
+
+// SubscribeOption configures a single Subscribe call.
+type SubscribeOption func(*mesh.SubscribeOptions)
+
+// WithGroup joins a shared subscription: the relay delivers each message on the topic
+// to one member of group (round-robin) instead of to every subscriber. Publishers seal
+// for a single key, so all members must use the same Config.PrivateKey.
+func WithGroup(group string) SubscribeOption {
+	return func(o *mesh.SubscribeOptions) { o.Group = group }
+}
+
+// WithPersistent keeps the subscription on the relay while this client is offline:
+// messages sealed for its key are queued as ciphertext and delivered, in order, when
+// a client with the same Config.PrivateKey subscribes again. Cannot be combined with WithGroup.
+func WithPersistent() SubscribeOption {
+	return func(o *mesh.SubscribeOptions) { o.Persistent = true }
 }
 
 // Config configures the Qumbed client.
@@ -38,14 +139,90 @@ type Config struct {
 	DisableDiscovery bool
 	// MessageBuffer sets the capacity of Messages() channel; 0 uses DefaultMessageBuffer.
 	MessageBuffer int
+	// PrivateKey is the Curve25519 private key for E2EE; nil generates a new one.
+	// Use GeneratePrivateKey to create one to share (e.g. across a consumer group).
+	PrivateKey *[crypto.PrivateKeySize]byte
+	// Schemas validates payloads on Publish and Subscribe; nil uses the built-in schemas.
+	Schemas *SchemaRegistry
+	// Strict validates every topic in strict mode: unknown fields, missing required fields
+	// and out-of-range values are rejected on Publish and dropped on receive.
+	Strict bool
+	// StrictTopics enables strict mode for individual topics (or filters such as
+	// "sensors/#") when Strict is false.
+	StrictTopics []string
+	// Backpressure decides what happens when Messages(), a typed subscription channel or
+	// a handler queue is full; the default DropNewest discards the incoming message.
+	Backpressure BackpressurePolicy
+	// SpillDir is where SpillToDisk keeps its overflow file, created with mode 0600.
+	// Required with SpillToDisk: the file holds decrypted messages, so choose a private
+	// directory (not a shared temp directory).
+	SpillDir string
+	// SpillMaxBytes caps the messages waiting in the overflow file; 0 uses
+	// DefaultSpillMaxBytes. Messages that do not fit are dropped.
+	SpillMaxBytes int64
+	// OnDrop is called for every message discarded by the backpressure policy. It runs on
+	// the receive path and must not block.
+	OnDrop func(ReceivedMessage)
+	// OnHandlerError receives errors returned (or panics recovered) by handlers registered
+	// with Handle; nil logs them.
+	OnHandlerError func(topic string, err error)
+	// Will is published by the relay if this client's connection drops without Close
+	// (crash, network loss). Requires RelayAddr; the client connects in New.
+	Will *Will
+	// Presence has the relay publish {"node_id","online","timestamp_ms"} on
+	// PresenceTopic(NodeID), retained, when this client connects and disconnects.
+	Presence bool
+	// AuthToken is the bearer token for a relay that requires authentication.
+	AuthToken string
+	// TokenSource supplies the bearer token instead of AuthToken: on start and, for
+	// JWTs, shortly before each token expires, so the connection stays authorized.
+	TokenSource func(ctx context.Context) (string, error)
+	// TLS configures the relay connection: set Certificates for mutual-TLS
+	// authentication and RootCAs (or ServerName) to verify the relay. nil skips
+	// verification of the relay's certificate (development only).
+	TLS *tls.Config
+	// TraceExporter receives publish, receive and handler spans. nil records none, but
+	// the trace context of a Publish's ctx is still sealed into the message (see
+	// ContextWithTraceparent) and available to the subscriber (TraceContext).
+	TraceExporter TraceExporter
+	// TraceRelay also sends the traceparent in cleartext so a relay with a trace
+	// exporter records its forwarding in the same trace. The relay then sees trace IDs.
+	TraceRelay bool
+}
+
+// Will is a last-will message: Topic, SchemaID and Payload as for Publish, sealed for
+// Recipient (nil: this client's own key); Retain keeps it as the topic's last value.
+type Will = mesh.Will
+
+// PresenceTopic returns the topic the relay publishes nodeID's presence on. Subscribe
+// to "$presence/+" for every node (a leading wildcard does not match "$" topics).
+func PresenceTopic(nodeID string) string {
+	return mesh.PresenceTopic(nodeID)
 }
 
-// Client is the developer-facing Qumbed client. Use Publish/Subscribe and read from Messages().
+// Client is the developer-facing Qumbed client. Use Publish/Subscribe and read from Messages(),
+// or route topics to handlers with Handle.
 type Client struct {
 	node   *mesh.Node
 	msgs   chan ReceivedMessage
 	closed bool
 	mu     sync.Mutex
+	done   chan struct{} // closed by Close; unblocks Block/SpillToDisk sends
+
+	policy  BackpressurePolicy
+	spill   *spool // SpillToDisk overflow for msgs
+	onDrop  func(ReceivedMessage)
+	dropped atomic.Uint64
+
+	routesMu sync.RWMutex
+	routes   map[string][]*route // topic filter -> typed subscribers (see SubscribeTyped)
+	bufSize  int
+
+	mux           router // see Handle
+	handlerCtx    context.Context
+	handlerCancel context.CancelFunc
+	onHandlerErr  func(topic string, err error)
+	tracer        *trace.Tracer
 }
 
 // New creates a new Qumbed client. Call Subscribe to receive messages; read them from Messages().
@@ -53,50 +230,209 @@ func New(ctx context.Context, cfg Config) (*Client, error) {
 	if cfg.Addr == "" {
 		cfg.Addr = ":0"
 	}
+	if cfg.Backpressure == SpillToDisk && cfg.SpillDir == "" {
+		return nil, errNoSpillDir
+	}
 	buf := cfg.MessageBuffer
 	if buf <= 0 {
 		buf = DefaultMessageBuffer
 	}
-	msgs := make(chan ReceivedMessage, buf)
+	c := &Client{
+		msgs:         make(chan ReceivedMessage, buf),
+		done:         make(chan struct{}),
+		policy:       cfg.Backpressure,
+		onDrop:       cfg.OnDrop,
+		routes:       make(map[string][]*route),
+		bufSize:      buf,
+		mux:          router{entries: make(map[string]*handlerEntry)},
+		onHandlerErr: cfg.OnHandlerError,
+		tracer:       trace.NewTracer(cfg.TraceExporter),
+	}
+	if cfg.Backpressure == SpillToDisk {
+		sp, err := newSpool(cfg.SpillDir, cfg.SpillMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		c.spill = sp
+		go sp.pump(c.msgs, c.done)
+	}
+	var keys *crypto.KeyPair
+	if cfg.PrivateKey != nil {
+		var err error
+		if keys, err = crypto.KeyPairFromPrivate(cfg.PrivateKey); err != nil {
+			return nil, err
+		}
+	}
+	c.handlerCtx, c.handlerCancel = context.WithCancel(ctx)
 	node, err := mesh.NewNode(ctx, mesh.Config{
-		Addr:              cfg.Addr,
-		NodeID:             cfg.NodeID,
-		RelayAddr:         cfg.RelayAddr,
-		DisableDiscovery:  cfg.DisableDiscovery,
-		OnMessage: func(topic string, payload []byte) {
-			select {
-			case msgs <- ReceivedMessage{Topic: topic, Payload: payload}:
-			default:
-				// channel full; drop or could log
+		Addr:             cfg.Addr,
+		NodeID:           cfg.NodeID,
+		RelayAddr:        cfg.RelayAddr,
+		DisableDiscovery: cfg.DisableDiscovery,
+		Keys:             keys,
+		Schemas:          cfg.Schemas,
+		Strict:           cfg.Strict,
+		StrictTopics:     cfg.StrictTopics,
+		Will:             cfg.Will,
+		Presence:         cfg.Presence,
+		AuthToken:        cfg.AuthToken,
+		TokenSource:      cfg.TokenSource,
+		TLS:              cfg.TLS,
+		TraceExporter:    cfg.TraceExporter,
+		TraceRelay:       cfg.TraceRelay,
+		OnMessage: func(m mesh.Message) {
+			rm := receivedMessage(m)
+			handled := c.dispatch(rm)
+			if e := c.mux.match(rm.Topic); e != nil {
+				handled = true
+				e.enqueue(rm, c.policy, c.done, c.drop)
+			}
+			if !handled {
+				c.deliver(rm)
 			}
 		},
 	})
 	if err != nil {
+		c.handlerCancel()
+		close(c.done)
+		if c.spill != nil {
+			c.spill.close()
+		}
 		return nil, err
 	}
-	return &Client{node: node, msgs: msgs}, nil
+	c.node = node
+	return c, nil
 }
 
 // Publish sends a message to a topic. Payload must match schemaID (e.g. proto.SchemaTemperature).
 // recipientPub is the subscriber's public key for E2EE; use nil to publish to self (demo only).
-func (c *Client) Publish(ctx context.Context, topic, schemaID string, payload []byte, recipientPub *[crypto.PublicKeySize]byte) error {
+func (c *Client) Publish(ctx context.Context, topic, schemaID string, payload []byte, recipientPub *[crypto.PublicKeySize]byte, opts ...PublishOption) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.closed {
 		return ErrClosed
 	}
-	return c.node.Publish(ctx, topic, schemaID, payload, recipientPub)
+	if recipientPub == nil {
+		recipientPub = c.node.PublicKey()
+	}
+	var o mesh.PublishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return c.node.PublishWithOptions(ctx, topic, schemaID, payload, recipientPub, o)
+}
+
+// ClearRetained removes the relay's retained message on topic for recipientPub,
+// or for every recipient if recipientPub is nil.
+func (c *Client) ClearRetained(ctx context.Context, topic string, recipientPub *[crypto.PublicKeySize]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.node.ClearRetained(ctx, topic, recipientPub)
+}
+
+// Unmarshal decodes a received payload into v (a pointer to a JSON-tagged struct),
+// transcoding protobuf payloads with the schema's descriptor first.
+func (c *Client) Unmarshal(m ReceivedMessage, v interface{}) error {
+	payload, err := c.node.Schemas().Transcode(m.SchemaID, m.Encoding, EncodingJSON, m.Payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
 }
 
-// Subscribe registers for a topic and starts receiving messages on Messages().
+// Subscribe registers for a topic and starts receiving messages on Messages()
+// (unless a handler or typed subscription takes them, see Handle and SubscribeTyped).
+// The topic may be a filter: "+" matches one level, a trailing "#" any number of levels.
 // Must be called with a non-empty RelayAddr in Config.
-func (c *Client) Subscribe(ctx context.Context, topic, schemaID string) error {
+func (c *Client) Subscribe(ctx context.Context, topic, schemaID string, opts ...SubscribeOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	var o mesh.SubscribeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return c.node.SubscribeWithOptions(ctx, topic, schemaID, o)
+}
+
+// Unsubscribe stops receiving topic (a filter passed to Subscribe without WithGroup).
+// For a persistent subscription the relay also discards its queue.
+func (c *Client) Unsubscribe(ctx context.Context, topic string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.closed {
 		return ErrClosed
 	}
-	return c.node.Subscribe(ctx, topic, schemaID)
+	return c.node.Unsubscribe(ctx, topic)
+}
+
+// Request publishes payload like Publish and waits for the recipient's reply (see Reply),
+// which is E2EE-encrypted for this client. ctx bounds the wait. Replies go to a private
+// "$inbox/..." topic this client subscribes to on first use; they never reach Messages().
+func (c *Client) Request(ctx context.Context, topic, schemaID string, payload []byte, recipientPub *[crypto.PublicKeySize]byte, opts ...PublishOption) (ReceivedMessage, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ReceivedMessage{}, ErrClosed
+	}
+	c.mu.Unlock()
+	if recipientPub == nil {
+		recipientPub = c.node.PublicKey()
+	}
+	var o mesh.PublishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	m, err := c.node.Request(ctx, topic, schemaID, payload, recipientPub, o)
+	if err != nil {
+		return ReceivedMessage{}, err
+	}
+	return receivedMessage(m), nil
+}
+
+// Reply answers a request received from Messages(), a handler or a typed subscription.
+// payload must match schemaID; it is sealed for the requester.
+func (c *Client) Reply(ctx context.Context, req ReceivedMessage, schemaID string, payload []byte, opts ...PublishOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	var o mesh.PublishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return c.node.Reply(ctx, mesh.Message{Sender: req.Sender, ReplyTo: req.ReplyTo, CorrelationID: req.CorrelationID}, schemaID, payload, o)
+}
+
+func receivedMessage(m mesh.Message) ReceivedMessage {
+	return ReceivedMessage{
+		Topic:          m.Topic,
+		Payload:        m.Payload,
+		SchemaID:       m.SchemaID,
+		Encoding:       m.Encoding,
+		Retained:       m.Retained,
+		Sender:         m.Sender,
+		ReplyTo:        m.ReplyTo,
+		CorrelationID:  m.CorrelationID,
+		Headers:        m.Headers,
+		RoutingHeaders: m.RoutingHeaders,
+		trace:          m.Trace,
+	}
+}
+
+// GeneratePrivateKey returns a new Curve25519 private key for Config.PrivateKey.
+func GeneratePrivateKey() (*[crypto.PrivateKeySize]byte, error) {
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return kp.Private, nil
 }
 
 // Messages returns the channel of received messages. Read until the client is closed.
@@ -109,11 +445,22 @@ func (c *Client) PublicKey() *[crypto.PublicKeySize]byte {
 	return c.node.PublicKey()
 }
 
+// Schemas returns the registry used to validate payloads.
+func (c *Client) Schemas() *SchemaRegistry {
+	return c.node.Schemas()
+}
+
 // Addr returns the local QUIC listen address.
 func (c *Client) Addr() string {
 	return c.node.Addr()
 }
 
+// Metrics returns an http.Handler serving the client's metrics in the Prometheus
+// text format (publishes, received and dropped messages, relay connection and bytes).
+func (c *Client) Metrics() http.Handler {
+	return c.node.Metrics()
+}
+
 // Close shuts down the client and closes the Messages() channel.
 func (c *Client) Close() error {
 	c.mu.Lock()
@@ -123,14 +470,34 @@ func (c *Client) Close() error {
 	}
 	c.closed = true
 	c.mu.Unlock()
+	close(c.done)
 	err := c.node.Close()
+	if c.spill != nil {
+		c.spill.close()
+	}
 	close(c.msgs)
+	c.closeRoutes()
+	c.handlerCancel()
+	c.mux.stopAll()
 	return err
 }
 
+// SchemaRegistry holds the schemas a client validates against (re-export from proto).
+type SchemaRegistry = proto.SchemaRegistry
+
+// NewSchemaRegistry returns a registry preloaded with the built-in schemas.
+// Register more with RegisterStruct, RegisterJSONSchema, RegisterDescriptor or LoadDir.
+func NewSchemaRegistry() *SchemaRegistry {
+	return proto.NewDefaultRegistry()
+}
+
 // Schema constants for convenience (re-export from proto).
 var (
 	SchemaTemperature = proto.SchemaTemperature
 	SchemaHumidity    = proto.SchemaHumidity
 	SchemaCommand     = proto.SchemaCommand
+	SchemaPresence    = proto.SchemaPresence
 )
+
+// Presence is the payload of a presence message (see Config.Presence).
+type Presence = proto.Presence
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/mesh"
+	"github.com/SWAI-Ltd/Qumbed/internal/trace"
+)
+
+// startRelay runs a relay on a free local port until the test ends
+func startRelay(t *testing.T) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := mesh.RunRelay(ctx, "127.0.0.1:0")
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+		r.Shutdown(sctx)
+		scancel()
+		cancel()
+	})
+	return r.Addr()
+}
+
+func newTestClient(t *testing.T, relay string, cfg Config) *Client {
+	t.Helper()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.RelayAddr = relay
+	cfg.DisableDiscovery = true
+	c, err := New(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// TestBlockHandlerReply has a handler with a one-message queue and the Block policy
+// answer more requests than fit: its Reply must get the relay's Ack while the
+// handler queue is full.
+func TestBlockHandlerReply(t *testing.T) {
+	const requests = 20
+	relay := startRelay(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	server := newTestClient(t, relay, Config{Backpressure: Block})
+	err := server.Handle("rpc/echo", func(ctx context.Context, m ReceivedMessage) error {
+		return server.Reply(ctx, m, SchemaTemperature, m.Payload)
+	}, WithQueueSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Subscribe(ctx, "rpc/echo", SchemaTemperature); err != nil {
+		t.Fatal(err)
+	}
+
+	requester := newTestClient(t, relay, Config{})
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(fmt.Sprintf(`{"celsius":%d,"timestamp_ms":1,"sensor_id":"s"}`, i))
+			reply, err := requester.Request(ctx, "rpc/echo", SchemaTemperature, payload, server.PublicKey())
+			if err == nil && string(reply.Payload) != string(payload) {
+				err = fmt.Errorf("got reply %s, want %s", reply.Payload, payload)
+			}
+			if err != nil {
+				errs <- fmt.Errorf("request %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestStrictNeedsSchema checks that strict topics reject schema-less subscribes and
+// publishes up front, while inbox subscriptions for Request still work
+func TestStrictNeedsSchema(t *testing.T) {
+	relay := startRelay(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := newTestClient(t, relay, Config{StrictTopics: []string{"sensors/#"}})
+	for _, filter := range []string{"sensors/temp", "sensors/+/temp", "#"} {
+		if err := c.Subscribe(ctx, filter, ""); err == nil {
+			t.Errorf("Subscribe(%q) without a schema succeeded on a strict topic", filter)
+		}
+	}
+	if err := c.Subscribe(ctx, "other/temp", ""); err != nil {
+		t.Errorf("Subscribe(other/temp): %v", err)
+	}
+	if err := c.Publish(ctx, "sensors/temp", "", []byte(`{}`), nil); err == nil {
+		t.Error("Publish without a schema succeeded on a strict topic")
+	}
+
+	server := newTestClient(t, relay, Config{})
+	err := server.Handle("rpc/echo", func(ctx context.Context, m ReceivedMessage) error {
+		return server.Reply(ctx, m, SchemaTemperature, m.Payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Subscribe(ctx, "rpc/echo", SchemaTemperature); err != nil {
+		t.Fatal(err)
+	}
+	requester := newTestClient(t, relay, Config{Strict: true})
+	payload := []byte(`{"celsius":20,"timestamp_ms":1,"sensor_id":"s"}`)
+	if _, err := requester.Request(ctx, "rpc/echo", SchemaTemperature, payload, server.PublicKey()); err != nil {
+		t.Errorf("strict Request: %v", err)
+	}
+}
+
+// TestSpoolTraceContext checks that a spilled message keeps its trace context
+func TestSpoolTraceContext(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := trace.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []ReceivedMessage{{Topic: "traced", trace: sc}, {Topic: "untraced"}} {
+		if err := s.push(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ch := make(chan ReceivedMessage)
+	go s.pump(ch, make(chan struct{}))
+	defer s.close()
+	if m := <-ch; m.Topic != "traced" || m.trace != sc {
+		t.Errorf("got %q with trace %v, want %q with %v", m.Topic, m.trace, "traced", sc)
+	}
+	if m := <-ch; m.Topic != "untraced" || m.trace.IsValid() {
+		t.Errorf("got %q with trace %v, want %q without one", m.Topic, m.trace, "untraced")
+	}
+}
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+	"github.com/SWAI-Ltd/Qumbed/internal/trace"
+)
+
+const (
+	// DefaultHandlerQueue is the per-worker queue size for Handle.
+	DefaultHandlerQueue = 64
+)
+
+// HandlerFunc processes a message routed by Client.Handle. A returned error (or a
+// recovered panic) is passed to Config.OnHandlerError.
+type HandlerFunc func(ctx context.Context, m ReceivedMessage) error
+
+// HandlerOption configures a handler registered with Handle.
+type HandlerOption func(*handlerEntry)
+
+// WithWorkers runs the handler on n goroutines (default 1). Messages of one topic
+// always go to the same worker, so per-topic order is kept.
+func WithWorkers(n int) HandlerOption {
+	return func(e *handlerEntry) {
+		if n > 0 {
+			e.workers = n
+		}
+	}
+}
+
+// WithQueueSize sets the per-worker queue size (default DefaultHandlerQueue).
+func WithQueueSize(n int) HandlerOption {
+	return func(e *handlerEntry) {
+		if n > 0 {
+			e.queueSize = n
+		}
+	}
+}
+
+// router matches topics to handlers like http.ServeMux matches paths: a pattern is
+// an exact topic ("sensors/temp"), a subtree if it ends in "/" ("sensors/" matches
+// "sensors/temp" and "sensors/room1/temp") or a wildcard filter ("sensors/+/temp",
+// "sensors/#"). An exact match wins, then the longest matching pattern.
+type router struct {
+	mu      sync.RWMutex
+	entries map[string]*handlerEntry
+}
+
+type handlerEntry struct {
+	pattern   string
+	h         HandlerFunc
+	workers   int
+	queueSize int
+	queues    []chan ReceivedMessage
+	wg        sync.WaitGroup
+	mu        sync.RWMutex // guards stopped against enqueue racing with stop
+	stopped   bool
+	quit      chan struct{} // closed on stop, before taking mu, to unblock a blocked enqueue
+	quitOnce  sync.Once
+}
+
+// Handle routes messages whose topic matches pattern to h, instead of Messages().
+// Handle only routes; call Subscribe for the topics you want to receive.
+// Registering the same pattern twice is an error.
+func (c *Client) Handle(pattern string, h HandlerFunc, opts ...HandlerOption) error {
+	if pattern == "" {
+		return fmt.Errorf("client: empty handler pattern")
+	}
+	if h == nil {
+		return fmt.Errorf("client: nil handler for %q", pattern)
+	}
+	if err := topic.ValidateFilter(pattern); err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	e := &handlerEntry{pattern: pattern, h: h, workers: 1, queueSize: DefaultHandlerQueue, quit: make(chan struct{})}
+	for _, opt := range opts {
+		opt(e)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.mux.mu.Lock()
+	defer c.mux.mu.Unlock()
+	if _, ok := c.mux.entries[pattern]; ok {
+		return fmt.Errorf("client: handler already registered for %q", pattern)
+	}
+	e.start(c.handlerCtx, c.tracer, c.reportHandlerError)
+	c.mux.entries[pattern] = e
+	return nil
+}
+
+// Unhandle removes the handler for pattern. Queued messages are still processed.
+func (c *Client) Unhandle(pattern string) {
+	c.mux.mu.Lock()
+	e, ok := c.mux.entries[pattern]
+	delete(c.mux.entries, pattern)
+	c.mux.mu.Unlock()
+	if ok {
+		e.stop()
+	}
+}
+
+// match returns the handler for topic name, or nil
+func (r *router) match(name string) *handlerEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e, ok := r.entries[name]; ok {
+		return e
+	}
+	var best *handlerEntry
+	for p, e := range r.entries {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(name, p) || topic.Match(p, name) {
+			if best == nil || len(p) > len(best.pattern) {
+				best = e
+			}
+		}
+	}
+	return best
+}
+
+func (r *router) stopAll() {
+	r.mu.Lock()
+	all := r.entries
+	r.entries = make(map[string]*handlerEntry)
+	r.mu.Unlock()
+	for _, e := range all {
+		e.stop()
+	}
+}
+
+func (e *handlerEntry) start(ctx context.Context, tracer *trace.Tracer, onErr func(topic string, err error)) {
+	e.queues = make([]chan ReceivedMessage, e.workers)
+	for i := range e.queues {
+		q := make(chan ReceivedMessage, e.queueSize)
+		e.queues[i] = q
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			for m := range q {
+				mctx, span := tracer.Start(m.TraceContext(ctx), "process "+m.Topic, trace.KindConsumer)
+				span.SetAttribute("messaging.system", "qumbed")
+				span.SetAttribute("messaging.destination.name", m.Topic)
+				span.SetAttribute("qumbed.handler", e.pattern)
+				err := e.call(mctx, m)
+				span.SetError(err)
+				span.End()
+				if err != nil {
+					onErr(m.Topic, err)
+				}
+			}
+		}()
+	}
+}
+
+// call runs the handler, turning a panic into an error
+func (e *handlerEntry) call(ctx context.Context, m ReceivedMessage) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("handler %q panicked: %v\n%s", e.pattern, p, debug.Stack())
+		}
+	}()
+	return e.h(ctx, m)
+}
+
+// enqueue hands m to the worker owning its topic, applying policy when its queue is
+// full (SpillToDisk blocks). Messages for a stopped handler are dropped.
+func (e *handlerEntry) enqueue(m ReceivedMessage, policy BackpressurePolicy, done <-chan struct{}, onDrop func(ReceivedMessage)) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.stopped {
+		onDrop(m)
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(m.Topic))
+	q := e.queues[h.Sum32()%uint32(len(e.queues))]
+	if policy == Block || policy == SpillToDisk {
+		select {
+		case q <- m:
+		case <-e.quit:
+			onDrop(m)
+		case <-done:
+			onDrop(m)
+		}
+		return
+	}
+	offer(q, m, policy, done, onDrop)
+}
+
+func (e *handlerEntry) stop() {
+	e.quitOnce.Do(func() { close(e.quit) })
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		return
+	}
+	e.stopped = true
+	for _, q := range e.queues {
+		close(q)
+	}
+	e.mu.Unlock()
+	e.wg.Wait()
+}
+
+func (c *Client) reportHandlerError(topic string, err error) {
+	if c.onHandlerErr != nil {
+		c.onHandlerErr(topic, err)
+		return
+	}
+	slog.Error("client: handler failed", "topic", topic, "err", err)
+}
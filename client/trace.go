@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+	"github.com/SWAI-Ltd/Qumbed/internal/trace"
+)
+
+// HeaderTraceparent is the sealed header carrying the W3C trace context of a publish.
+const HeaderTraceparent = proto.HeaderTraceparent
+
+// TraceExporter receives finished spans (see Config.TraceExporter). ExportSpan runs on
+// the publishing or receiving goroutine and must not block.
+type TraceExporter = trace.Exporter
+
+// TraceExporterFunc adapts a function to a TraceExporter.
+type TraceExporterFunc = trace.ExporterFunc
+
+// Span is a finished publish, receive or handler span. Its Attributes follow the
+// OpenTelemetry messaging conventions (messaging.destination.name and so on).
+type Span = trace.Span
+
+// SpanContext identifies a span across processes (trace ID, span ID, flags).
+type SpanContext = trace.SpanContext
+
+// Span kinds.
+const (
+	SpanKindInternal = trace.KindInternal
+	SpanKindProducer = trace.KindProducer
+	SpanKindConsumer = trace.KindConsumer
+)
+
+// ContextWithTraceparent returns ctx carrying the trace context of a W3C traceparent
+// value, so a Publish with it joins that trace. Use it to continue a trace started by
+// another tracing library, e.g. one injected into a map by an OpenTelemetry propagator.
+func ContextWithTraceparent(ctx context.Context, traceparent string) (context.Context, error) {
+	sc, err := trace.ParseTraceparent(traceparent)
+	if err != nil {
+		return ctx, err
+	}
+	return trace.ContextWithSpanContext(ctx, sc), nil
+}
+
+// Traceparent returns the W3C traceparent value of the trace context in ctx; empty if
+// there is none.
+func Traceparent(ctx context.Context) string {
+	return trace.SpanContextFromContext(ctx).Traceparent()
+}
+
+// TraceContext returns ctx carrying the message's trace context, so spans and
+// publishes started from it (e.g. Reply) continue the publisher's trace. Handlers
+// registered with Handle already receive such a context.
+func (m ReceivedMessage) TraceContext(ctx context.Context) context.Context {
+	sc := m.trace
+	if !sc.IsValid() {
+		sc, _ = trace.ParseTraceparent(m.Headers[HeaderTraceparent])
+	}
+	if !sc.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithSpanContext(ctx, sc)
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
+	"github.com/SWAI-Ltd/Qumbed/internal/mesh"
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+)
+
+// Typed is a received message decoded into T.
+type Typed[T any] struct {
+	Topic string
+	Value T
+	// Message is the raw message (payload, writer's schema ID, encoding).
+	Message ReceivedMessage
+}
+
+// SchemaIDOf returns the schema ID registered for T in the client's registry
+// (e.g. "sensor.Temperature@1" for proto.Temperature).
+func SchemaIDOf[T any](c *Client) (string, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	id, ok := c.Schemas().SchemaIDFor(t)
+	if !ok {
+		return "", fmt.Errorf("no schema registered for type %s (use RegisterStruct)", t)
+	}
+	return id, nil
+}
+
+// PublishTyped marshals v, validates it against the schema registered for T and publishes it.
+// With WithEncoding(EncodingProtobuf) the value is sent in its protobuf form.
+func PublishTyped[T any](ctx context.Context, c *Client, topic string, v T, recipientPub *[crypto.PublicKeySize]byte, opts ...PublishOption) error {
+	id, err := SchemaIDOf[T](c)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var o mesh.PublishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if payload, err = c.Schemas().Transcode(id, EncodingJSON, o.Encoding, payload); err != nil {
+		return err
+	}
+	return c.Publish(ctx, topic, id, payload, recipientPub, opts...)
+}
+
+// SubscribeTyped subscribes to topic with the schema registered for T and returns a
+// channel of decoded messages. Messages matching topic (which may be a wildcard filter)
+// go to this channel instead of Messages(); those that do not decode into T are
+// dropped (see Dropped and Config.OnDrop).
+//
+// ctx is the lifetime of the subscription, not just of the Subscribe request: when it
+// is done the channel is closed and, unless another SubscribeTyped for the same topic
+// is still open, the client unsubscribes from the relay (for WithPersistent, discarding
+// its queue). Pass a cancelable context, not one with a short timeout. The channel is
+// also closed when the client is closed.
+func SubscribeTyped[T any](ctx context.Context, c *Client, topic string, opts ...SubscribeOption) (<-chan Typed[T], error) {
+	id, err := SchemaIDOf[T](c)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Typed[T], c.bufSize)
+	r := newRoute(c.done)
+	r.deliver = func(m ReceivedMessage) {
+		var v T
+		if err := c.Unmarshal(m, &v); err != nil {
+			slog.Debug("client: dropping undecodable message", "topic", m.Topic, "err", err)
+			c.drop(m)
+			return
+		}
+		offer(out, Typed[T]{Topic: m.Topic, Value: v, Message: m}, c.policy, r.quit,
+			func(t Typed[T]) { c.drop(t.Message) })
+	}
+	r.close = func() { close(out) }
+	if err := c.addRoute(topic, r); err != nil {
+		return nil, err
+	}
+	if err := c.Subscribe(ctx, topic, id, opts...); err != nil {
+		c.removeRoute(topic, r)
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.done:
+			return // Close stops the routes
+		}
+		if c.removeRoute(topic, r) {
+			var o mesh.SubscribeOptions
+			for _, opt := range opts {
+				opt(&o)
+			}
+			uctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.closed {
+				return
+			}
+			if err := c.node.UnsubscribeWithOptions(uctx, topic, o); err != nil {
+				slog.Debug("client: unsubscribe failed", "topic", topic, "err", err)
+			}
+		}
+	}()
+	return out, nil
+}
+
+// route is a typed subscriber; deliver and close are serialized by mu
+type route struct {
+	mu      sync.Mutex
+	done    bool
+	quit    chan struct{} // closed on stop, before taking mu, to unblock a blocked deliver
+	once    sync.Once
+	deliver func(ReceivedMessage)
+	close   func()
+}
+
+// newRoute returns a route that also stops blocking once clientDone is closed
+func newRoute(clientDone <-chan struct{}) *route {
+	r := &route{quit: make(chan struct{})}
+	go func() {
+		select {
+		case <-clientDone:
+			r.once.Do(func() { close(r.quit) })
+		case <-r.quit:
+		}
+	}()
+	return r
+}
+
+func (r *route) send(m ReceivedMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.done {
+		r.deliver(m)
+	}
+}
+
+func (r *route) stop() {
+	r.once.Do(func() { close(r.quit) })
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.done {
+		r.done = true
+		r.close()
+	}
+}
+
+func (c *Client) addRoute(topic string, r *route) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.routesMu.Lock()
+	c.routes[topic] = append(c.routes[topic], r)
+	c.routesMu.Unlock()
+	return nil
+}
+
+// removeRoute stops r and reports whether it was the last route for topic
+func (c *Client) removeRoute(topic string, r *route) bool {
+	c.routesMu.Lock()
+	rs := c.routes[topic]
+	for i, x := range rs {
+		if x == r {
+			c.routes[topic] = append(rs[:i:i], rs[i+1:]...)
+			break
+		}
+	}
+	last := len(c.routes[topic]) == 0
+	if last {
+		delete(c.routes, topic)
+	}
+	c.routesMu.Unlock()
+	r.stop()
+	return last
+}
+
+// dispatch hands m to the typed subscribers whose filter matches its topic; false if there are none
+func (c *Client) dispatch(m ReceivedMessage) bool {
+	var rs []*route
+	c.routesMu.RLock()
+	for filter, fr := range c.routes {
+		if topic.Match(filter, m.Topic) {
+			rs = append(rs, fr...)
+		}
+	}
+	c.routesMu.RUnlock()
+	for _, r := range rs {
+		r.send(m)
+	}
+	return len(rs) > 0
+}
+
+func (c *Client) closeRoutes() {
+	c.routesMu.Lock()
+	all := c.routes
+	c.routes = make(map[string][]*route)
+	c.routesMu.Unlock()
+	for _, rs := range all {
+		for _, r := range rs {
+			r.stop()
+		}
+	}
+}
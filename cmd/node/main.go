@@ -2,19 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
 	"github.com/SWAI-Ltd/Qumbed/internal/mesh"
 	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+	"github.com/SWAI-Ltd/Qumbed/internal/trace"
 )
 
 func main() {
@@ -22,11 +26,44 @@ func main() {
 	relayAddr := flag.String("relay", "localhost:6121", "relay address (empty to disable)")
 	noDiscovery := flag.Bool("no-discovery", false, "disable mDNS (use when relay-only or in containers)")
 	nodeID := flag.String("id", "node-1", "node id")
-	mode := flag.String("mode", "sub", "sub | pub")
+	mode := flag.String("mode", "sub", "sub | pub | request")
 	topic := flag.String("topic", "sensors/temp", "topic")
 	recipientKey := flag.String("recipient-key", "", "recipient public key (hex) for pub mode")
+	encodingFlag := flag.String("encoding", "json", "payload encoding for pub mode: json | protobuf")
+	strict := flag.Bool("strict", false, "strict schema validation for -topic (no unknown fields, required fields, value bounds)")
+	retain := flag.Bool("retain", false, "pub mode: relay keeps the message and replays it to new subscribers")
+	group := flag.String("group", "", "shared subscription group for sub mode (each message goes to one member)")
+	persistent := flag.Bool("persistent", false, "sub mode: relay queues messages while this node is offline (needs a stable -private-key)")
+	reply := flag.Bool("reply", false, "sub mode: answer requests by echoing their payload")
+	token := flag.String("token", "", "bearer token for a relay that requires authentication")
+	tokenFile := flag.String("token-file", "", "file holding the bearer token; re-read before a JWT expires")
+	clientCert := flag.String("client-cert", "", "client certificate (PEM) for mutual-TLS authentication with the relay")
+	clientKey := flag.String("client-key", "", "private key (PEM) for -client-cert")
+	presence := flag.Bool("presence", false, "relay publishes this node's online/offline status on $presence/<id> (id must be the key ID, the authenticated subject or granted by the relay's ACL)")
+	willTopic := flag.String("will-topic", "", "last-will topic, published by the relay if this node drops without a clean close")
+	willPayload := flag.String("will-payload", `{"action":"offline"}`, "last-will payload (JSON, validated against -will-schema)")
+	willSchema := flag.String("will-schema", proto.SchemaCommand, "last-will schema ID")
+	traceSpans := flag.Bool("trace", false, "log publish and receive spans; the trace context travels sealed with each message")
+	traceRelay := flag.Bool("trace-relay", false, "also send the traceparent in cleartext so the relay's -trace spans join the trace")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics on http://<addr>/metrics (e.g. :9091); empty disables")
+	privateKey := flag.String("private-key", "", "private key (hex) to use instead of a generated one; share it across -group members")
+	headers := make(map[string]string)
+	flag.Func("header", "pub/request mode: key=value header sealed with the payload (repeatable)", func(v string) error {
+		k, val, ok := strings.Cut(v, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("want key=value, got %q", v)
+		}
+		headers[k] = val
+		return nil
+	})
 	flag.Parse()
 
+	encoding, err := proto.ParseEncoding(*encodingFlag)
+	if err != nil {
+		slog.Error("invalid -encoding", "err", err)
+		os.Exit(1)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -42,13 +79,89 @@ func main() {
 		relay = *relayAddr
 	}
 
-	node, err := mesh.NewNode(ctx, mesh.Config{
+	var keys *crypto.KeyPair
+	if *privateKey != "" {
+		b, err := hex.DecodeString(*privateKey)
+		if err != nil || len(b) != crypto.PrivateKeySize {
+			slog.Error("invalid private-key", "err", err)
+			os.Exit(1)
+		}
+		var priv [crypto.PrivateKeySize]byte
+		copy(priv[:], b)
+		if keys, err = crypto.KeyPairFromPrivate(&priv); err != nil {
+			slog.Error("invalid private-key", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var will *mesh.Will
+	if *willTopic != "" {
+		// sealed for this node's key unless -recipient-key is set
+		will = &mesh.Will{Topic: *willTopic, SchemaID: *willSchema, Payload: []byte(*willPayload)}
+		if *recipientKey != "" {
+			b, err := hex.DecodeString(*recipientKey)
+			if err != nil || len(b) != crypto.PublicKeySize {
+				slog.Error("invalid recipient-key", "err", err)
+				os.Exit(1)
+			}
+			will.Recipient = new([crypto.PublicKeySize]byte)
+			copy(will.Recipient[:], b)
+		}
+	}
+
+	var tlsCfg *tls.Config
+	if *clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			slog.Error("failed to load client certificate", "err", err)
+			os.Exit(1)
+		}
+		// the relay certificate is still not verified (development)
+		tlsCfg = &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+	}
+
+	var tokenSource func(context.Context) (string, error)
+	if *tokenFile != "" {
+		tokenSource = func(context.Context) (string, error) {
+			b, err := os.ReadFile(*tokenFile)
+			return strings.TrimSpace(string(b)), err
+		}
+	}
+
+	var exporter trace.Exporter
+	if *traceSpans {
+		exporter = trace.LogExporter(nil)
+	}
+
+	var node *mesh.Node
+	node, err = mesh.NewNode(ctx, mesh.Config{
 		Addr:             *addr,
 		NodeID:           *nodeID,
 		RelayAddr:        relay,
 		DisableDiscovery: *noDiscovery,
-		OnMessage: func(t string, payload []byte) {
-			slog.Info("message received", "topic", t, "payload", string(payload))
+		Keys:             keys,
+		StrictTopics:     strictTopics(*strict, *topic),
+		Will:             will,
+		Presence:         *presence,
+		AuthToken:        *token,
+		TokenSource:      tokenSource,
+		TLS:              tlsCfg,
+		TraceExporter:    exporter,
+		TraceRelay:       *traceRelay,
+		OnMessage: func(m mesh.Message) {
+			payload, err := proto.DefaultRegistry.Transcode(m.SchemaID, m.Encoding, proto.EncodingJSON, m.Payload)
+			if err != nil {
+				payload = m.Payload
+			}
+			slog.Info("message received", "topic", m.Topic, "payload", string(payload), "retained", m.Retained, "headers", m.Headers)
+			if *reply && m.ReplyTo != "" {
+				go func() {
+					rctx := trace.ContextWithSpanContext(ctx, m.Trace)
+					if err := node.Reply(rctx, m, m.SchemaID, m.Payload, mesh.PublishOptions{Encoding: m.Encoding}); err != nil {
+						slog.Error("reply failed", "err", err)
+					}
+				}()
+			}
 		},
 	})
 	if err != nil {
@@ -56,18 +169,28 @@ func main() {
 		os.Exit(1)
 	}
 	defer node.Close()
+	if *metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", node.Metrics())
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				slog.Error("metrics server failed", "err", err)
+			}
+		}()
+	}
 
 	slog.Info("node started", "addr", node.Addr(), "id", *nodeID)
 	fmt.Println("PublicKey:", hex.EncodeToString(node.PublicKey()[:]))
 
 	switch *mode {
 	case "sub":
-		if err := node.Subscribe(ctx, *topic, proto.SchemaTemperature); err != nil {
+		opts := mesh.SubscribeOptions{Group: *group, Persistent: *persistent}
+		if err := node.SubscribeWithOptions(ctx, *topic, proto.SchemaTemperature, opts); err != nil {
 			slog.Error("subscribe failed", "err", err)
 		}
-		slog.Info("subscribed", "topic", *topic)
+		slog.Info("subscribed", "topic", *topic, "group", *group, "persistent", *persistent)
 		<-ctx.Done()
-	case "pub":
+	case "pub", "request":
 		var pub *[crypto.PublicKeySize]byte
 		if *recipientKey != "" {
 			b, err := hex.DecodeString(*recipientKey)
@@ -85,13 +208,37 @@ func main() {
 			TimestampMs: time.Now().UnixMilli(),
 			SensorID:   *nodeID,
 		})
-		if err := node.Publish(ctx, *topic, proto.SchemaTemperature, payload, pub); err != nil {
+		payload, err = proto.DefaultRegistry.Transcode(proto.SchemaTemperature, proto.EncodingJSON, encoding, payload)
+		if err != nil {
+			slog.Error("encode failed", "err", err)
+			os.Exit(1)
+		}
+		opts := mesh.PublishOptions{Encoding: encoding, Retain: *retain, Headers: headers}
+		if *mode == "request" {
+			rctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			m, err := node.Request(rctx, *topic, proto.SchemaTemperature, payload, pub, opts)
+			cancel()
+			if err != nil {
+				slog.Error("request failed", "err", err)
+				os.Exit(1)
+			}
+			slog.Info("reply received", "topic", m.Topic, "payload", string(m.Payload))
+			return
+		}
+		if err := node.PublishWithOptions(ctx, *topic, proto.SchemaTemperature, payload, pub, opts); err != nil {
 			slog.Error("publish failed", "err", err)
 		} else {
 			slog.Info("published", "topic", *topic)
 		}
 		<-ctx.Done()
 	default:
-		fmt.Println("usage: node -mode sub|pub [-relay localhost:6121] [-topic sensors/temp] [-recipient-key <hex>]")
+		fmt.Println("usage: node -mode sub|pub|request [-relay localhost:6121] [-topic sensors/temp] [-recipient-key <hex>] [-group <name> -private-key <hex>] [-persistent -private-key <hex>] [-reply]")
+	}
+}
+
+func strictTopics(strict bool, topic string) []string {
+	if !strict {
+		return nil
 	}
+	return []string{topic}
 }
@@ -21,8 +21,17 @@ func main() {
 	relay := flag.String("relay", "localhost:6121", "relay address")
 	topic := flag.String("topic", "test", "topic to listen on")
 	schema := flag.String("schema", "sensor.Temperature", "expected schema (sensor.Temperature, sensor.Humidity, control.Command)")
+	strict := flag.Bool("strict", false, "strict validation (no unknown fields, required fields, value bounds)")
+	schemaDir := flag.String("schema-dir", "", "directory of extra schema files (*.json JSON Schema, *.binpb descriptor sets)")
 	flag.Parse()
 
+	schemas := proto.NewDefaultRegistry()
+	if *schemaDir != "" {
+		if err := schemas.LoadDir(*schemaDir); err != nil {
+			log.Fatalf("load schemas: %v", err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	sigCh := make(chan os.Signal, 1)
@@ -35,6 +44,7 @@ func main() {
 		RelayAddr:         *relay,
 		DisableDiscovery:  true,
 		MessageBuffer:     32,
+		Schemas:           schemas,
 	})
 	if err != nil {
 		log.Fatalf("connect failed: %v", err)
@@ -57,7 +67,7 @@ func main() {
 			if !ok {
 				return
 			}
-			valid, err := validatePayload(schemaID, m.Payload)
+			valid, err := validatePayload(schemas, schemaID, m.Encoding, m.Payload, *strict)
 			if valid {
 				okCount++
 				fmt.Printf("[%s] OK  %s -> %s\n", time.Now().Format("15:04:05"), m.Topic, string(m.Payload))
@@ -69,8 +79,13 @@ func main() {
 	}
 }
 
-func validatePayload(schemaID string, payload []byte) (valid bool, err error) {
-	if err := proto.ValidatePayload(schemaID, payload); err != nil {
+func validatePayload(schemas *proto.SchemaRegistry, schemaID string, enc proto.Encoding, payload []byte, strict bool) (valid bool, err error) {
+	if strict {
+		err = schemas.ValidateStrict(schemaID, enc, payload)
+	} else {
+		err = schemas.ValidateEncoded(schemaID, enc, payload)
+	}
+	if err != nil {
 		return false, err
 	}
 	return true, nil
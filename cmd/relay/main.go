@@ -1,36 +1,289 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/SWAI-Ltd/Qumbed/internal/mesh"
+	"github.com/SWAI-Ltd/Qumbed/internal/trace"
 )
 
 func main() {
 	addr := flag.String("addr", ":6121", "listen address")
+	sessionMaxBytes := flag.Int("session-max-bytes", mesh.DefaultSessionMaxBytes, "ciphertext queued per offline persistent subscriber (oldest dropped first)")
+	sessionTTL := flag.Duration("session-ttl", mesh.DefaultSessionTTL, "how long queued messages and offline persistent sessions are kept")
+	tlsCert := flag.String("tls-cert", "", "server certificate (PEM); empty uses a self-signed development certificate")
+	tlsKey := flag.String("tls-key", "", "server private key (PEM) for -tls-cert")
+	authTokens := flag.String("auth-tokens", "", "file of \"<token> <subject>\" lines; clients authenticate with a bearer token")
+	authClientCA := flag.String("auth-client-ca", "", "CA bundle (PEM); clients authenticate with a certificate it signed (mutual TLS)")
+	authKeys := flag.String("auth-keys", "", "file of \"<public key hex> <subject>\" lines; clients authenticate by proving their key")
+	authJWKS := flag.String("auth-jwks", "", "JSON Web Key Set file; clients authenticate with EdDSA/ES256 JWT capability tokens signed by these keys")
+	jwtIssuer := flag.String("auth-jwt-issuer", "", "required JWT \"iss\" claim (with -auth-jwks)")
+	jwtAudience := flag.String("auth-jwt-audience", "", "required JWT \"aud\" claim (with -auth-jwks)")
+	sendQueue := flag.Int("send-queue", mesh.DefaultSendQueue, "messages queued per connection before -overflow applies")
+	overflow := flag.String("overflow", "drop", "when a connection's send queue is full: drop (the message) | disconnect (the slow consumer)")
+	rateConn := flag.String("rate-conn", "", "publish limit per connection: \"<messages/s>,<bytes/s>\" (0 = unlimited)")
+	rateIdentity := flag.String("rate-identity", "", "publish limit per identity (subject or key) across its connections: \"<messages/s>,<bytes/s>\"")
+	rateTopic := flag.String("rate-topic", "", "publish limit per topic across publishers: \"<messages/s>,<bytes/s>\"")
+	rateOverrides := flag.String("rate-overrides", "", "file of \"subject:<name> <rate>\" and \"topic:<pattern> <rate>\" lines overriding -rate-identity and -rate-topic")
+	aclFile := flag.String("acl", "", "topic ACL file of \"<identity> <publish|subscribe|all> <pattern>...\" lines; unlisted access is denied")
+	aclReload := flag.Duration("acl-reload", 5*time.Second, "how often to check -acl for changes (0 disables reloading)")
+	traceSpans := flag.Bool("trace", false, "log a span per forwarded publish (joins the publisher's trace if it sent a traceparent routing header)")
+	logLevel := new(slog.LevelVar)
+	flag.TextVar(logLevel, "log-level", logLevel, "log level: debug | info | warn | error (changeable at runtime through the admin API)")
+	adminAddr := flag.String("admin-addr", "127.0.0.1:6180", "admin HTTP API listen address (with -admin-token-file)")
+	adminTokenFile := flag.String("admin-token-file", "", "file holding the admin API bearer token; enables the admin API on -admin-addr")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "on SIGINT/SIGTERM, how long to let clients drain and move to another relay before closing their connections")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics on http://<addr>/metrics (e.g. :9090); empty disables")
 	flag.Parse()
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+
+	policy, err := mesh.ParseOverflowPolicy(*overflow)
+	if err != nil {
+		slog.Error("invalid -overflow", "err", err)
+		os.Exit(1)
+	}
+	cfg := mesh.RelayConfig{
+		Addr:            *addr,
+		SessionMaxBytes: *sessionMaxBytes,
+		SessionTTL:      *sessionTTL,
+		SendQueue:       *sendQueue,
+		Overflow:        policy,
+		LogLevel:        logLevel,
+	}
+	if *traceSpans {
+		cfg.TraceExporter = trace.LogExporter(nil)
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			slog.Error("failed to load TLS certificate", "err", err)
+			os.Exit(1)
+		}
+		cfg.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	var jwtAuth *mesh.JWTAuthenticator
+	if *authJWKS != "" {
+		keys, err := mesh.LoadKeySet(*authJWKS)
+		if err != nil {
+			slog.Error("failed to load JWT key set", "err", err)
+			os.Exit(1)
+		}
+		jwtAuth = &mesh.JWTAuthenticator{Keys: keys, Issuer: *jwtIssuer, Audience: *jwtAudience, Leeway: 30 * time.Second}
+	}
+	auth, err := authenticator(*authTokens, *authClientCA, *authKeys, jwtAuth)
+	if err != nil {
+		slog.Error("failed to configure authentication", "err", err)
+		os.Exit(1)
+	}
+	cfg.Authenticator = auth
+	if cfg.RateLimits, err = rateLimits(*rateConn, *rateIdentity, *rateTopic, *rateOverrides); err != nil {
+		slog.Error("failed to configure rate limits", "err", err)
+		os.Exit(1)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-		<-sig
-		cancel()
-	}()
+	if *aclFile != "" {
+		acl, err := mesh.OpenACLFile(*aclFile)
+		if err != nil {
+			slog.Error("failed to load ACL", "err", err)
+			os.Exit(1)
+		}
+		cfg.Authorizer = acl
+		if *aclReload > 0 {
+			go acl.Watch(ctx, *aclReload)
+		}
+	}
 
-	srv, err := mesh.RunRelay(ctx, *addr)
+	srv, err := mesh.RunRelayWithConfig(ctx, cfg)
 	if err != nil {
 		slog.Error("failed to start relay", "err", err)
 		os.Exit(1)
 	}
-	<-ctx.Done()
-	_ = srv
-	slog.Info("relay shutting down")
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr, srv.Metrics())
+	}
+	if *adminTokenFile != "" {
+		b, err := os.ReadFile(*adminTokenFile)
+		token := strings.TrimSpace(string(b))
+		if err == nil && token == "" {
+			err = errors.New("empty token")
+		}
+		if err != nil {
+			slog.Error("failed to read admin token", "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			slog.Info("serving admin API", "addr", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, srv.AdminHandler(token)); err != nil {
+				slog.Error("admin server failed", "err", err)
+			}
+		}()
+	}
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	slog.Info("relay shutting down", "timeout", *shutdownTimeout)
+	sctx, scancel := context.WithTimeout(ctx, *shutdownTimeout)
+	go func() {
+		// a second signal skips the drain
+		select {
+		case <-sig:
+			scancel()
+		case <-sctx.Done():
+		}
+	}()
+	if err := srv.Shutdown(sctx); err != nil {
+		slog.Warn("relay shutdown incomplete", "err", err)
+	}
+	scancel()
+}
+
+// serveMetrics serves h on addr at /metrics
+func serveMetrics(addr string, h http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", h)
+	slog.Info("serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("metrics server failed", "err", err)
+	}
+}
+
+// authenticator combines the configured authentication methods; nil if none is set
+func authenticator(tokensFile, clientCAFile, keysFile string, jwtAuth *mesh.JWTAuthenticator) (mesh.Authenticator, error) {
+	var auths []mesh.Authenticator
+	if jwtAuth != nil {
+		auths = append(auths, jwtAuth)
+	}
+	if tokensFile != "" {
+		tokens, err := readPairs(tokensFile)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, &mesh.TokenAuthenticator{Tokens: tokens})
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCAFile)
+		}
+		auths = append(auths, &mesh.CertAuthenticator{Roots: roots})
+	}
+	if keysFile != "" {
+		keys, err := readPairs(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, &mesh.KeyAuthenticator{Keys: keys})
+	}
+	switch len(auths) {
+	case 0:
+		return nil, nil
+	case 1:
+		return auths[0], nil
+	}
+	return mesh.AnyAuthenticator(auths...), nil
+}
+
+// rateLimits builds the relay's publish limits from flags and an overrides file
+func rateLimits(conn, identity, topic, overridesFile string) (mesh.RateLimits, error) {
+	var limits mesh.RateLimits
+	for _, f := range []struct {
+		s    string
+		rate *mesh.Rate
+	}{{conn, &limits.Connection}, {identity, &limits.Identity}, {topic, &limits.Topic}} {
+		if f.s == "" {
+			continue
+		}
+		r, err := mesh.ParseRate(f.s)
+		if err != nil {
+			return limits, err
+		}
+		*f.rate = r
+	}
+	if overridesFile == "" {
+		return limits, nil
+	}
+	// in file order: the first matching topic pattern wins
+	overrides, err := readLines(overridesFile)
+	if err != nil {
+		return limits, err
+	}
+	limits.Identities = make(map[string]mesh.Rate)
+	for _, o := range overrides {
+		k := o[0]
+		r, err := mesh.ParseRate(o[1])
+		if err != nil {
+			return limits, fmt.Errorf("%s: %s: %v", overridesFile, k, err)
+		}
+		switch {
+		case strings.HasPrefix(k, "subject:"):
+			limits.Identities[strings.TrimPrefix(k, "subject:")] = r
+		case strings.HasPrefix(k, "topic:"):
+			limits.Topics = append(limits.Topics, mesh.TopicRate{Pattern: strings.TrimPrefix(k, "topic:"), Rate: r})
+		default:
+			return limits, fmt.Errorf("%s: %q: want subject:<name> or topic:<pattern>", overridesFile, k)
+		}
+	}
+	return limits, nil
+}
+
+// readPairs reads "<key> <value>" lines, skipping blank lines and # comments
+func readPairs(path string) (map[string]string, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(lines))
+	for _, l := range lines {
+		out[l[0]] = l[1]
+	}
+	return out, nil
+}
+
+// readLines reads "<key> <value>" lines in order, skipping blank lines and # comments
+func readLines(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out [][2]string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: want \"<key> <value>\"", path, n)
+		}
+		out = append(out, [2]string{k, strings.TrimSpace(v)})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, errors.New(path + ": no entries")
+	}
+	return out, nil
 }
@@ -7,7 +7,6 @@ package main
 import (
 	"context"
 	"encoding/hex"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -54,25 +53,13 @@ func main() {
 
 	switch *mode {
 	case "sub":
-		if err := c.Subscribe(ctx, *topic, client.SchemaTemperature); err != nil {
+		temps, err := client.SubscribeTyped[proto.Temperature](ctx, c, *topic)
+		if err != nil {
 			log.Fatal(err)
 		}
 		log.Println("subscribed to", *topic, "- waiting for messages...")
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case m, ok := <-c.Messages():
-				if !ok {
-					return
-				}
-				var t proto.Temperature
-				if json.Unmarshal(m.Payload, &t) == nil {
-					log.Printf("received %s: %.1f°C from %s", m.Topic, t.Celsius, t.SensorID)
-				} else {
-					log.Printf("received %s: %s", m.Topic, string(m.Payload))
-				}
-			}
+		for m := range temps {
+			log.Printf("received %s: %.1f°C from %s", m.Topic, m.Value.Celsius, m.Value.SensorID)
 		}
 	case "pub":
 		var recipient *[crypto.PublicKeySize]byte
@@ -86,12 +73,12 @@ func main() {
 		} else {
 			recipient = c.PublicKey()
 		}
-		payload, _ := json.Marshal(proto.Temperature{
+		reading := proto.Temperature{
 			Celsius:     22.0,
 			TimestampMs: time.Now().UnixMilli(),
 			SensorID:    "simple-pub",
-		})
-		if err := c.Publish(ctx, *topic, client.SchemaTemperature, payload, recipient); err != nil {
+		}
+		if err := client.PublishTyped(ctx, c, *topic, reading, recipient); err != nil {
 			log.Fatal(err)
 		}
 		log.Println("published to", *topic)
@@ -6,6 +6,7 @@ require (
 	github.com/betamos/zeroconf v0.1.7
 	github.com/quic-go/quic-go v0.40.1
 	golang.org/x/crypto v0.32.0
+	google.golang.org/protobuf v1.36.1
 )
 
 require (
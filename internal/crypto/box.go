@@ -2,8 +2,10 @@ package crypto
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"io"
 
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -28,6 +30,19 @@ func GenerateKeyPair() (*KeyPair, error) {
 	return &KeyPair{Public: public, Private: private}, nil
 }
 
+// KeyPairFromPrivate derives the key pair for an existing private key
+// (e.g. one shared by the members of a consumer group)
+func KeyPairFromPrivate(private *[PrivateKeySize]byte) (*KeyPair, error) {
+	pub, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	kp := &KeyPair{Public: new([PublicKeySize]byte), Private: new([PrivateKeySize]byte)}
+	copy(kp.Public[:], pub)
+	copy(kp.Private[:], private[:])
+	return kp, nil
+}
+
 // Seal encrypts plaintext for the recipient. Overhead is box.Overhead bytes.
 func Seal(plaintext []byte, recipient *[PublicKeySize]byte, sender *[PrivateKeySize]byte) ([]byte, error) {
 	var nonce [NonceSize]byte
@@ -47,6 +62,19 @@ func Open(ciphertext []byte, sender *[PublicKeySize]byte, recipient *[PrivateKey
 	return box.Open(nil, ciphertext[NonceSize:], &nonce, sender, recipient)
 }
 
+// Prove answers a key-possession challenge: it seals the challenge for the verifier's
+// (one-time) public key with our private key, which only the holder of that private key can do
+func Prove(challenge []byte, verifier *[PublicKeySize]byte, private *[PrivateKeySize]byte) ([]byte, error) {
+	return Seal(challenge, verifier, private)
+}
+
+// VerifyProof checks a Prove result: proof must open with the prover's public key
+// and the verifier's private key and contain the challenge
+func VerifyProof(proof, challenge []byte, prover *[PublicKeySize]byte, verifier *[PrivateKeySize]byte) bool {
+	plain, ok := Open(proof, prover, verifier)
+	return ok && subtle.ConstantTimeCompare(plain, challenge) == 1
+}
+
 // KeyID returns first 8 bytes of public key as routing ID
 func KeyID(pub *[PublicKeySize]byte) []byte {
 	return pub[:8]
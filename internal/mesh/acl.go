@@ -0,0 +1,242 @@
+package mesh
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+)
+
+// Action is what a client asks the relay to do with a topic
+type Action string
+
+const (
+	ActionPublish   Action = "publish"
+	ActionSubscribe Action = "subscribe"
+)
+
+// Principal is who a relay connection is, as far as the relay knows
+type Principal struct {
+	NodeID string
+	KeyID  []byte    // crypto.KeyID of the proven public key; nil without Connect
+	Auth   *Identity // set by the Authenticator; nil if none is configured
+}
+
+// Authorizer decides which topics a connection may publish to and subscribe to.
+// For ActionSubscribe, name is the subscription filter.
+type Authorizer interface {
+	Allow(p *Principal, action Action, name string) bool
+}
+
+// ACL is a list of rules granting identities publish or subscribe patterns; what no
+// rule grants is denied. Parse it with ParseACL.
+type ACL struct {
+	rules []aclRule
+}
+
+type aclRule struct {
+	who       string // "*", "anonymous", "subject:<name>" or "keyid:<hex>"
+	publish   bool
+	subscribe bool
+	patterns  []string
+}
+
+// ParseACL reads rules, one per line:
+//
+//	<identity> <publish|subscribe|all> <pattern> [<pattern>...]
+//
+// identity is "*" (any connection), "anonymous" (not authenticated), "subject:<name>"
+// (token subject, certificate CN or key name from the Authenticator) or "keyid:<hex>"
+// (first 8 bytes of the proven public key). Patterns are topic filters; a subscription
+// is allowed if its filter is covered by a pattern. Blank lines and # comments are skipped.
+func ParseACL(r io.Reader) (*ACL, error) {
+	a := &ACL{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("acl line %d: want \"<identity> <publish|subscribe|all> <pattern>...\"", n)
+		}
+		rule := aclRule{who: fields[0], patterns: fields[2:]}
+		switch {
+		case rule.who == "*", rule.who == "anonymous":
+		case strings.HasPrefix(rule.who, "subject:") && len(rule.who) > len("subject:"):
+		case strings.HasPrefix(rule.who, "keyid:"):
+			if _, err := hex.DecodeString(strings.TrimPrefix(rule.who, "keyid:")); err != nil {
+				return nil, fmt.Errorf("acl line %d: invalid key ID: %v", n, err)
+			}
+		default:
+			return nil, fmt.Errorf("acl line %d: unknown identity %q", n, rule.who)
+		}
+		switch fields[1] {
+		case "publish":
+			rule.publish = true
+		case "subscribe":
+			rule.subscribe = true
+		case "all":
+			rule.publish, rule.subscribe = true, true
+		default:
+			return nil, fmt.Errorf("acl line %d: unknown action %q", n, fields[1])
+		}
+		for _, p := range rule.patterns {
+			if err := topic.ValidateFilter(p); err != nil {
+				return nil, fmt.Errorf("acl line %d: %v", n, err)
+			}
+		}
+		a.rules = append(a.rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// LoadACL parses the ACL file at path
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// Allow reports whether a rule for p grants action on name
+func (a *ACL) Allow(p *Principal, action Action, name string) bool {
+	for _, r := range a.rules {
+		if !r.grants(action) || !r.applies(p) {
+			continue
+		}
+		for _, pat := range r.patterns {
+			if action == ActionSubscribe && topic.Covers(pat, name) || action == ActionPublish && topic.Match(pat, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *aclRule) grants(action Action) bool {
+	return action == ActionPublish && r.publish || action == ActionSubscribe && r.subscribe
+}
+
+func (r *aclRule) applies(p *Principal) bool {
+	switch {
+	case r.who == "*":
+		return true
+	case r.who == "anonymous":
+		return p.Auth == nil
+	case strings.HasPrefix(r.who, "subject:"):
+		return p.Auth != nil && p.Auth.Subject == strings.TrimPrefix(r.who, "subject:")
+	case strings.HasPrefix(r.who, "keyid:"):
+		return p.KeyID != nil && hex.EncodeToString(p.KeyID) == strings.ToLower(strings.TrimPrefix(r.who, "keyid:"))
+	}
+	return false
+}
+
+// ACLFile is an ACL loaded from a file and reloaded when the file changes (see Watch)
+type ACLFile struct {
+	path string
+	acl  atomic.Pointer[ACL]
+
+	mu       sync.Mutex // serializes reloads
+	modTime  time.Time
+	onReload []func()
+}
+
+// OpenACLFile loads the ACL at path
+func OpenACLFile(path string) (*ACLFile, error) {
+	f := &ACLFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OnReload registers fn to be called after every successful reload. The relay uses it
+// to drop existing subscriptions the new rules deny (see RelayServer.RecheckSubscriptions).
+func (f *ACLFile) OnReload(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onReload = append(f.onReload, fn)
+}
+
+// Allow checks the current ACL
+func (f *ACLFile) Allow(p *Principal, action Action, name string) bool {
+	return f.acl.Load().Allow(p, action, name)
+}
+
+// Reload re-reads the file; on error the previous ACL stays in effect
+func (f *ACLFile) Reload() error {
+	f.mu.Lock()
+	err := f.reload()
+	fns := f.onReload
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, fn := range fns {
+		fn()
+	}
+	return nil
+}
+
+func (f *ACLFile) reload() error {
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	acl, err := LoadACL(f.path)
+	if err != nil {
+		return err
+	}
+	f.acl.Store(acl)
+	f.modTime = st.ModTime()
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes, checking every
+// interval until ctx is done. Publish checks use the new rules immediately; existing
+// subscriptions are rechecked by the OnReload callbacks.
+func (f *ACLFile) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			f.mu.Lock()
+			st, err := os.Stat(f.path)
+			if err != nil || st.ModTime().Equal(f.modTime) {
+				f.mu.Unlock()
+				continue
+			}
+			err = f.reload()
+			f.modTime = st.ModTime() // don't retry a broken file until it changes again
+			fns := f.onReload
+			f.mu.Unlock()
+			if err != nil {
+				slog.Error("relay: acl reload failed, keeping previous rules", "path", f.path, "err", err)
+				continue
+			}
+			slog.Info("relay: acl reloaded", "path", f.path, "rules", len(f.acl.Load().rules))
+			for _, fn := range fns {
+				fn()
+			}
+		}
+	}
+}
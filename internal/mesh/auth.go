@@ -0,0 +1,132 @@
+package mesh
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Authenticator decides whether a relay connection may publish and subscribe. It runs
+// once per connection, after the client's Connect has proven possession of its key.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req *AuthRequest) (*Identity, error)
+}
+
+// AuthRequest holds the credentials a client presented
+type AuthRequest struct {
+	NodeID           string
+	PublicKey        []byte // Curve25519 key, proven by the Connect/Challenge/Prove handshake
+	Token            string // bearer token from the Connect frame
+	PeerCertificates []*x509.Certificate
+}
+
+// Identity is an authenticated client
+type Identity struct {
+	Subject string // who the client is (token owner, certificate CN, key name)
+	Method  string // authenticator that accepted it: "token", "mtls", "key" or "jwt"
+	// Expires, if set, is when the credential stops being valid; the relay closes the
+	// connection then unless the client re-authenticates
+	Expires time.Time
+	// Grants, if set, limit the topics and schemas the client may use
+	Grants *Grants
+}
+
+// ErrUnauthenticated is returned by authenticators for missing or unknown credentials
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// AuthenticatorFunc adapts a function to Authenticator
+type AuthenticatorFunc func(ctx context.Context, req *AuthRequest) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, req *AuthRequest) (*Identity, error) {
+	return f(ctx, req)
+}
+
+// TokenAuthenticator accepts static bearer tokens: token -> subject
+type TokenAuthenticator struct {
+	Tokens map[string]string
+}
+
+func (a *TokenAuthenticator) Authenticate(_ context.Context, req *AuthRequest) (*Identity, error) {
+	if req.Token == "" {
+		return nil, fmt.Errorf("%w: no token", ErrUnauthenticated)
+	}
+	// compare every token in constant time so timing does not reveal a prefix match
+	var subject string
+	found := 0
+	for tok, sub := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(req.Token)) == 1 {
+			subject, found = sub, 1
+		}
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("%w: invalid token", ErrUnauthenticated)
+	}
+	return &Identity{Subject: subject, Method: "token"}, nil
+}
+
+// CertAuthenticator accepts client certificates (mutual TLS) that chain to Roots and
+// allow client authentication. The subject is the certificate's common name.
+type CertAuthenticator struct {
+	Roots *x509.CertPool
+}
+
+func (a *CertAuthenticator) Authenticate(_ context.Context, req *AuthRequest) (*Identity, error) {
+	if len(req.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("%w: no client certificate", ErrUnauthenticated)
+	}
+	leaf := req.PeerCertificates[0]
+	inter := x509.NewCertPool()
+	for _, c := range req.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.Roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: client certificate: %v", ErrUnauthenticated, err)
+	}
+	return &Identity{Subject: leaf.Subject.CommonName, Method: "mtls"}, nil
+}
+
+// KeyAuthenticator accepts clients by their proven Curve25519 public key: hex key ->
+// subject. A nil Keys map accepts any key that passed the proof (subject = key hex).
+type KeyAuthenticator struct {
+	Keys map[string]string
+}
+
+func (a *KeyAuthenticator) Authenticate(_ context.Context, req *AuthRequest) (*Identity, error) {
+	key := hex.EncodeToString(req.PublicKey)
+	if a.Keys == nil {
+		return &Identity{Subject: key, Method: "key"}, nil
+	}
+	subject, ok := a.Keys[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key", ErrUnauthenticated)
+	}
+	return &Identity{Subject: subject, Method: "key"}, nil
+}
+
+// AnyAuthenticator tries each authenticator in turn and accepts the first success
+func AnyAuthenticator(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, req *AuthRequest) (*Identity, error) {
+		reasons := make([]string, 0, len(auths))
+		for _, a := range auths {
+			id, err := a.Authenticate(ctx, req)
+			if err == nil {
+				return id, nil
+			}
+			reasons = append(reasons, strings.TrimPrefix(err.Error(), ErrUnauthenticated.Error()+": "))
+		}
+		if len(reasons) == 0 {
+			return nil, ErrUnauthenticated
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnauthenticated, strings.Join(reasons, "; "))
+	})
+}
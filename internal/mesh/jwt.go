@@ -0,0 +1,292 @@
+package mesh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+)
+
+// Grants are the topics and schemas a credential allows. Publish topics must match a
+// Publish pattern and Subscribe filters must be covered by a Subscribe pattern; an
+// empty Schemas list allows any schema. With a Schemas list, subscriptions without a
+// schema are denied, except to inboxes.
+type Grants struct {
+	Publish   []string
+	Subscribe []string
+	Schemas   []string // schema IDs; an unversioned ID allows every version
+}
+
+// Allow reports whether the grants permit action on name with schemaID. Subscribing
+// to an inbox needs no schema grant: a Request subscribes without a schema, and the
+// relay lets only the inbox's owner subscribe.
+func (g *Grants) Allow(action Action, name, schemaID string) bool {
+	inbox := action == ActionSubscribe && strings.HasPrefix(name, InboxTopicPrefix)
+	if !inbox && !g.allowSchema(schemaID) {
+		return false
+	}
+	if action == ActionPublish {
+		for _, p := range g.Publish {
+			if topic.Match(p, name) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range g.Subscribe {
+		if topic.Covers(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Grants) allowSchema(id string) bool {
+	if len(g.Schemas) == 0 {
+		return true
+	}
+	name, _ := proto.ParseSchemaID(id)
+	for _, s := range g.Schemas {
+		if s == id || s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// KeySet holds the public keys JWTs are verified with. It is read from a JSON Web
+// Key Set: Ed25519 ("kty":"OKP") and P-256 ("kty":"EC") keys are supported.
+type KeySet struct {
+	keys []jwk
+}
+
+type jwk struct {
+	kid string
+	alg string // "EdDSA" or "ES256"
+	ed  ed25519.PublicKey
+	ec  *ecdsa.PublicKey
+}
+
+// ParseKeySet parses a JSON Web Key Set ({"keys":[...]})
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			Kid string `json:"kid"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("key set: %w", err)
+	}
+	ks := &KeySet{}
+	for i, k := range doc.Keys {
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("key set: key %d: x: %w", i, err)
+		}
+		switch {
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			if len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key set: key %d: invalid Ed25519 key", i)
+			}
+			ks.keys = append(ks.keys, jwk{kid: k.Kid, alg: "EdDSA", ed: ed25519.PublicKey(x)})
+		case k.Kty == "EC" && k.Crv == "P-256":
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("key set: key %d: y: %w", i, err)
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if len(x) != 32 || len(y) != 32 || !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("key set: key %d: invalid P-256 key", i)
+			}
+			ks.keys = append(ks.keys, jwk{kid: k.Kid, alg: "ES256", ec: pub})
+		default:
+			return nil, fmt.Errorf("key set: key %d: unsupported key type %s %s", i, k.Kty, k.Crv)
+		}
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("key set: no keys")
+	}
+	return ks, nil
+}
+
+// LoadKeySet reads a JSON Web Key Set file
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeySet(data)
+}
+
+// verify checks sig over signed with the keys for alg (only the key named kid, if set)
+func (ks *KeySet) verify(alg, kid string, signed, sig []byte) bool {
+	for _, k := range ks.keys {
+		if k.alg != alg || (kid != "" && k.kid != kid) {
+			continue
+		}
+		switch alg {
+		case "EdDSA":
+			if ed25519.Verify(k.ed, signed, sig) {
+				return true
+			}
+		case "ES256":
+			if len(sig) != 64 {
+				return false
+			}
+			h := sha256.Sum256(signed)
+			if ecdsa.Verify(k.ec, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// JWTAuthenticator accepts capability tokens: JWTs signed with EdDSA (Ed25519) or
+// ES256 by a key in Keys. The "sub" claim is the subject and "exp" is required.
+// The "publish", "subscribe" and "schemas" claims become the connection's Grants,
+// enforced on every Publish and Subscribe; the relay closes the connection when
+// the token expires unless the client sends a fresh one (Auth frame).
+type JWTAuthenticator struct {
+	Keys     *KeySet
+	Issuer   string        // required "iss", if set
+	Audience string        // required in "aud", if set
+	Leeway   time.Duration // clock skew tolerated on "exp" and "nbf"
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt float64  `json:"exp"`
+	NotBefore float64  `json:"nbf"`
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+	Schemas   []string `json:"schemas"`
+}
+
+// audience is the "aud" claim: a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a *JWTAuthenticator) Authenticate(_ context.Context, req *AuthRequest) (*Identity, error) {
+	if req.Token == "" {
+		return nil, fmt.Errorf("%w: no token", ErrUnauthenticated)
+	}
+	claims, err := a.verify(req.Token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: jwt: %v", ErrUnauthenticated, err)
+	}
+	return &Identity{
+		Subject: claims.Subject,
+		Method:  "jwt",
+		Expires: time.Unix(int64(claims.ExpiresAt), 0).Add(a.Leeway),
+		Grants:  &Grants{Publish: claims.Publish, Subscribe: claims.Subscribe, Schemas: claims.Schemas},
+	}, nil
+}
+
+func (a *JWTAuthenticator) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	if header.Alg != "EdDSA" && header.Alg != "ES256" {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %v", err)
+	}
+	if !a.Keys.verify(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.New("invalid signature")
+	}
+	var c jwtClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	now := time.Now()
+	switch {
+	case c.Subject == "":
+		return nil, errors.New("missing sub")
+	case c.ExpiresAt == 0:
+		return nil, errors.New("missing exp")
+	case now.After(time.Unix(int64(c.ExpiresAt), 0).Add(a.Leeway)):
+		return nil, errors.New("token expired")
+	case c.NotBefore != 0 && now.Add(a.Leeway).Before(time.Unix(int64(c.NotBefore), 0)):
+		return nil, errors.New("token not yet valid")
+	case a.Issuer != "" && c.Issuer != a.Issuer:
+		return nil, fmt.Errorf("unexpected issuer %q", c.Issuer)
+	case a.Audience != "" && !contains(c.Audience, a.Audience):
+		return nil, errors.New("token not issued for this relay")
+	}
+	for _, p := range append(append([]string{}, c.Publish...), c.Subscribe...) {
+		if err := topic.ValidateFilter(p); err != nil {
+			return nil, fmt.Errorf("invalid topic pattern: %v", err)
+		}
+	}
+	return &c, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenExpiry reads the "exp" claim of a JWT without verifying it; zero if token is
+// not a JWT or does not expire
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	var c struct {
+		ExpiresAt float64 `json:"exp"`
+	}
+	if decodeSegment(parts[1], &c) != nil || c.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(c.ExpiresAt), 0)
+}
@@ -0,0 +1,32 @@
+package mesh
+
+import "testing"
+
+func TestGrantsSchemas(t *testing.T) {
+	g := &Grants{
+		Publish:   []string{"sensors/#", "$inbox/#"},
+		Subscribe: []string{"sensors/#", "$inbox/#"},
+		Schemas:   []string{"sensor.Temperature"},
+	}
+	tests := []struct {
+		action   Action
+		name     string
+		schemaID string
+		want     bool
+	}{
+		{ActionPublish, "sensors/temp", "sensor.Temperature", true},
+		{ActionPublish, "sensors/temp", "sensor.Temperature@2", true},
+		{ActionPublish, "sensors/temp", "sensor.Humidity", false},
+		{ActionSubscribe, "sensors/#", "sensor.Temperature", true},
+		{ActionSubscribe, "sensors/#", "", false},
+		// a Request's inbox subscription has no schema; its replies must still be granted
+		{ActionSubscribe, "$inbox/0f1e2d3c4b5a6978/1", "", true},
+		{ActionPublish, "$inbox/0f1e2d3c4b5a6978/1", "", false},
+		{ActionPublish, "$inbox/0f1e2d3c4b5a6978/1", "sensor.Temperature", true},
+	}
+	for _, tt := range tests {
+		if got := g.Allow(tt.action, tt.name, tt.schemaID); got != tt.want {
+			t.Errorf("Allow(%s, %q, %q) = %v, want %v", tt.action, tt.name, tt.schemaID, got, tt.want)
+		}
+	}
+}
@@ -2,12 +2,17 @@ package mesh
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
 
 	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
 	"github.com/SWAI-Ltd/Qumbed/internal/discovery"
 	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+	"github.com/SWAI-Ltd/Qumbed/internal/trace"
 	"github.com/SWAI-Ltd/Qumbed/internal/transport"
 )
 
@@ -18,13 +23,78 @@ type Node struct {
 	relay      *Relay
 	disc       *discovery.Discovery
 	peers      sync.Map // addr -> discovery.Peer
-	subs       sync.Map // topic -> map[addr]subInfo
-	schema     map[string]struct{}
-	onMsg      func(topic string, payload []byte)
+	subs       *topic.Trie[string, []byte] // filter -> peer addr -> peer public key
+	subSchemas *topic.Trie[string, string] // filter -> filter -> schema ID this node subscribed with
+	schemas    *proto.SchemaRegistry
+	strictAll  bool
+	strict     []string // topic filters validated in strict mode
+	onMsg      func(Message)
 	nodeID     string
-	relayAddr  string
-	relayConn  *transport.Conn
-	relayDone  chan struct{}
+	metrics    *nodeMetrics
+	tracer     *trace.Tracer
+	traceRelay bool
+
+	deliveries chan delivery // received messages waiting for onMsg, see deliverLoop
+	quit       chan struct{} // closed by Close
+	delivered  chan struct{} // closed when deliverLoop exits
+	closeOnce  sync.Once
+
+	inboxMu sync.Mutex // serializes subscribing the inbox
+	reqMu   sync.Mutex
+	inbox   string                     // reply topic of this node, subscribed on first Request
+	pending map[string]*pendingRequest // correlation ID -> waiting Request
+}
+
+// deliveryQueue is the number of received messages that wait for OnMessage before
+// the relay connection stops being read
+const deliveryQueue = 256
+
+// delivery is a received message and its receive span, ended once OnMessage returns
+type delivery struct {
+	msg  Message
+	span *trace.Span
+}
+
+// Message is a decrypted message delivered to OnMessage
+type Message struct {
+	Topic    string
+	Payload  []byte
+	SchemaID string                      // publisher's schema ID, if sent
+	Encoding proto.Encoding              // payload encoding; empty means JSON
+	Retained bool                        // replayed retained value rather than a live publish
+	Sender   *[crypto.PublicKeySize]byte // publisher's public key (nil for relay-generated messages)
+	// ReplyTo and CorrelationID are set on requests (see Request and Reply)
+	ReplyTo        string
+	CorrelationID  string
+	Headers        map[string]string // sealed with the payload
+	RoutingHeaders map[string]string // cleartext, as seen by the relay
+	// Trace is the receive span's context (the publisher's if not recording); zero
+	// if the message carried no traceparent and no span was recorded
+	Trace trace.SpanContext
+}
+
+// PublishOptions are optional Publish settings
+type PublishOptions struct {
+	Encoding proto.Encoding // payload encoding; the schema needs a protobuf descriptor for EncodingProtobuf
+	Retain   bool           // relay keeps the message and replays it to new subscribers of the topic
+	// ReplyTo and CorrelationID are set by Request and Reply
+	ReplyTo       string
+	CorrelationID string
+	// Headers are sealed with the payload; only the recipient can read them
+	Headers map[string]string
+	// RoutingHeaders travel in cleartext for the relay (see proto.ValidateRoutingHeaders)
+	RoutingHeaders map[string]string
+}
+
+// SubscribeOptions are optional Subscribe settings
+type SubscribeOptions struct {
+	// Group makes this a shared subscription: the relay delivers each message to one
+	// member of the group. Members must share a key pair (Config.Keys) to decrypt.
+	Group string
+	// Persistent keeps the subscription on the relay while this node is offline: messages
+	// sealed for its key are queued (as ciphertext) and delivered when it reconnects with
+	// the same key pair. Not supported for group subscriptions.
+	Persistent bool
 }
 
 // Config for Node
@@ -32,27 +102,80 @@ type Config struct {
 	Addr         string
 	NodeID       string
 	RelayAddr    string // optional relay for cross-network
-	OnMessage    func(topic string, payload []byte)
+	OnMessage    func(Message) // called on one goroutine, in order; it may Publish and Request
 	DisableDiscovery bool // set true to skip mDNS (e.g. in containers)
+	Schemas      *proto.SchemaRegistry // nil uses proto.DefaultRegistry
+	Keys         *crypto.KeyPair       // nil generates a new key pair
+	// Strict validates every topic in strict mode (see proto.SchemaRegistry.ValidateStrict).
+	// Strict topics need a schema ID to publish, and to subscribe except to inboxes.
+	Strict       bool
+	// StrictTopics lists topics (or filters such as "sensors/#") validated in strict mode when Strict is false
+	StrictTopics []string
+	// Will is published by the relay if this node's connection drops without Close
+	Will *Will
+	// Presence has the relay publish this node's status on PresenceTopic(NodeID)
+	Presence bool
+	// AuthToken is the bearer token sent to a relay that requires authentication
+	AuthToken string
+	// TokenSource, if set, supplies the bearer token instead of AuthToken. It is
+	// called on start and, for JWTs, again before each token expires.
+	TokenSource func(ctx context.Context) (string, error)
+	// TLS for the relay connection: a client certificate for mutual TLS, RootCAs to
+	// verify the relay. nil skips verification (development only).
+	TLS *tls.Config
+	// TraceExporter receives publish and receive spans; nil records none (the trace
+	// context in ctx is still propagated)
+	TraceExporter trace.Exporter
+	// TraceRelay also sends the traceparent as a cleartext routing header, so the
+	// relay's forward span joins the trace. The relay then sees trace and span IDs.
+	TraceRelay bool
+}
+
+// Will is a last-will message, registered with the relay when the node connects
+type Will struct {
+	Topic     string
+	SchemaID  string
+	Payload   []byte
+	Recipient *[crypto.PublicKeySize]byte // nil seals for this node's own key
+	Encoding  proto.Encoding
+	Retain    bool
 }
 
 // NewNode creates a new mesh node
 func NewNode(ctx context.Context, cfg Config) (*Node, error) {
-	keys, err := crypto.GenerateKeyPair()
-	if err != nil {
-		return nil, err
+	var err error
+	keys := cfg.Keys
+	if keys == nil {
+		if keys, err = crypto.GenerateKeyPair(); err != nil {
+			return nil, err
+		}
 	}
 
 	n := &Node{
 		keys:   keys,
 		nodeID: cfg.NodeID,
-		relayAddr: cfg.RelayAddr,
 		onMsg:  cfg.OnMessage,
-		schema: make(map[string]struct{}),
+		schemas: cfg.Schemas,
+		subs:       topic.NewTrie[string, []byte](),
+		subSchemas: topic.NewTrie[string, string](),
+		pending:    make(map[string]*pendingRequest),
+		deliveries: make(chan delivery, deliveryQueue),
+		quit:       make(chan struct{}),
+		delivered:  make(chan struct{}),
 	}
-	for _, s := range proto.KnownSchemas() {
-		n.schema[s] = struct{}{}
+	if n.schemas == nil {
+		n.schemas = proto.DefaultRegistry
 	}
+	n.metrics = newNodeMetrics(n)
+	n.tracer = trace.NewTracer(cfg.TraceExporter)
+	n.traceRelay = cfg.TraceRelay
+	n.strictAll = cfg.Strict
+	for _, t := range cfg.StrictTopics {
+		if err := topic.ValidateFilter(t); err != nil {
+			return nil, err
+		}
+	}
+	n.strict = cfg.StrictTopics
 
 	// Start QUIC server
 	n.server, err = transport.ListenQUIC(ctx, cfg.Addr)
@@ -77,13 +200,73 @@ func NewNode(ctx context.Context, cfg Config) (*Node, error) {
 		}
 	}
 
+	go n.deliverLoop()
+
 	// Connect to relay if configured
 	if cfg.RelayAddr != "" {
-		n.relay = NewRelay(cfg.RelayAddr)
+		if cfg.TokenSource != nil {
+			if cfg.AuthToken, err = cfg.TokenSource(ctx); err != nil {
+				n.Close()
+				return nil, fmt.Errorf("token source: %w", err)
+			}
+		}
+		hello, err := n.connectFrame(cfg)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		n.relay = NewRelay(cfg.RelayAddr, cfg.TLS, hello, keys, func(m *proto.MessageFrame) {
+			slog.Debug("relay: got message", "topic", m.Topic)
+			n.handleMessage(nil, m)
+		})
+		if cfg.TokenSource != nil {
+			go n.relay.refreshTokens(cfg.TokenSource)
+		}
+		// a will or presence only takes effect once connected, so do not wait for first use
+		if cfg.Will != nil || cfg.Presence {
+			if err := n.relay.connect(ctx); err != nil {
+				n.Close()
+				return nil, err
+			}
+		}
 	}
 	return n, nil
 }
 
+// connectFrame builds the Connect sent on every relay (re)connect, sealing the will
+func (n *Node) connectFrame(cfg Config) (*proto.ConnectFrame, error) {
+	hello := &proto.ConnectFrame{NodeID: cfg.NodeID, PublicKey: n.keys.Public[:], Presence: cfg.Presence, Token: cfg.AuthToken}
+	if cfg.Presence && !topic.IsLevel(cfg.NodeID) {
+		return nil, fmt.Errorf("presence: node ID %q must be a single topic level", cfg.NodeID)
+	}
+	if w := cfg.Will; w != nil {
+		if err := topic.ValidateName(w.Topic); err != nil {
+			return nil, err
+		}
+		if err := n.validate(w.Topic, w.SchemaID, w.Encoding, w.Payload); err != nil {
+			return nil, err
+		}
+		recipient := w.Recipient
+		if recipient == nil {
+			recipient = n.keys.Public
+		}
+		enc, err := crypto.Seal(w.Payload, recipient, n.keys.Private)
+		if err != nil {
+			return nil, err
+		}
+		hello.Will = &proto.PublishFrame{
+			Topic:           w.Topic,
+			Payload:         enc,
+			SchemaID:        w.SchemaID,
+			RecipientKeyID:  crypto.KeyID(recipient),
+			SenderPublicKey: n.keys.Public[:],
+			Encoding:        w.Encoding,
+			Retain:          w.Retain,
+		}
+	}
+	return hello, nil
+}
+
 func (n *Node) onPeerDiscovered(peer discovery.Peer) {
 	addr := discovery.AddrForQUIC(peer)
 	n.peers.Store(addr, peer)
@@ -123,28 +306,34 @@ func (n *Node) handleFrame(c *transport.Conn, f *proto.Frame) {
 }
 
 func (n *Node) handleSubscribe(c *transport.Conn, s *proto.SubscribeFrame) {
-	if _, ok := n.schema[s.SchemaID]; !ok && s.SchemaID != "" {
+	if err := topic.ValidateFilter(s.Topic); err != nil {
+		c.SendFrame(&proto.Frame{Type: proto.FrameTypeError, Error: &proto.ErrorFrame{
+			Code: "TOPIC_INVALID", Message: err.Error(),
+		}})
+		return
+	}
+	if s.SchemaID != "" && !n.schemas.Has(s.SchemaID) {
 		c.SendFrame(&proto.Frame{Type: proto.FrameTypeError, Error: &proto.ErrorFrame{
 			Code: "SCHEMA_UNKNOWN", Message: "unknown schema: " + s.SchemaID,
 		}})
 		return
 	}
-	key := c.RemoteAddr()
-	v, _ := n.subs.LoadOrStore(s.Topic, &sync.Map{})
-	m := v.(*sync.Map)
-	m.Store(key, s.PublicKey)
+	n.subs.Add(s.Topic, c.RemoteAddr(), s.PublicKey)
 	c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
 }
 
 func (n *Node) handleUnsubscribe(c *transport.Conn, u *proto.UnsubscribeFrame) {
-	if v, ok := n.subs.Load(u.Topic); ok {
-		m := v.(*sync.Map)
-		m.Delete(c.RemoteAddr())
-	}
+	n.subs.Remove(u.Topic, c.RemoteAddr())
 }
 
 func (n *Node) handlePublish(c *transport.Conn, p *proto.PublishFrame) {
-	if err := proto.ValidatePayload(p.SchemaID, p.Payload); err != nil {
+	if err := topic.ValidateName(p.Topic); err != nil {
+		c.SendFrame(&proto.Frame{Type: proto.FrameTypeError, Error: &proto.ErrorFrame{
+			Code: "TOPIC_INVALID", Message: err.Error(),
+		}})
+		return
+	}
+	if err := n.validate(p.Topic, p.SchemaID, p.Encoding, p.Payload); err != nil {
 		c.SendFrame(&proto.Frame{Type: proto.FrameTypeError, Error: &proto.ErrorFrame{
 			Code: "SCHEMA_INVALID", Message: err.Error(),
 		}})
@@ -156,111 +345,353 @@ func (n *Node) handlePublish(c *transport.Conn, p *proto.PublishFrame) {
 		EncryptedPayload: p.Payload,
 		SenderKeyID:      p.RecipientKeyID,
 		SenderPublicKey:  p.SenderPublicKey,
+		SchemaID:         p.SchemaID,
+		Encoding:         p.Encoding,
 	}
-	if v, ok := n.subs.Load(p.Topic); ok {
-		m := v.(*sync.Map)
-		m.Range(func(key, _ interface{}) bool {
-			// Would send to connection for key - simplified: ack only
-			return true
-		})
-		_ = msg
-	}
+	n.subs.Match(p.Topic, func(_, key string, _ []byte) {
+		// Would send to connection for key - simplified: ack only
+	})
+	_ = msg
 	c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
 }
 
 func (n *Node) handleMessage(c *transport.Conn, m *proto.MessageFrame) {
-	if len(m.SenderPublicKey) != crypto.PublicKeySize {
+	if m.System && c == nil {
+		// relay-generated (e.g. presence), only accepted from the relay session
+		if n.onMsg != nil {
+			n.enqueue(delivery{msg: Message{Topic: m.Topic, Payload: m.EncryptedPayload, SchemaID: m.SchemaID, Retained: m.Retained, RoutingHeaders: m.Headers}})
+		}
+		return
+	}
+	if len(m.SenderPublicKey) != crypto.PublicKeySize || !n.acceptsSchema(m.Topic, m.SchemaID) {
+		n.metrics.dropped.Inc()
 		return
 	}
 	var senderPub [crypto.PublicKeySize]byte
 	copy(senderPub[:], m.SenderPublicKey)
 	plain, ok := crypto.Open(m.EncryptedPayload, &senderPub, n.keys.Private)
 	if !ok {
+		n.metrics.dropped.Inc()
+		return
+	}
+	var headers map[string]string
+	if m.Envelope {
+		env, err := proto.UnmarshalEnvelope(plain)
+		if err != nil {
+			n.metrics.dropped.Inc()
+			slog.Debug("dropping message with malformed envelope", "topic", m.Topic, "err", err)
+			return
+		}
+		plain, headers = env.Payload, env.Headers
+	}
+	if n.isStrict(m.Topic) {
+		schemaID := m.SchemaID
+		if schemaID == "" {
+			schemaID = n.subscribedSchema(m.Topic)
+		}
+		if schemaID == "" {
+			// e.g. a reply sent without one, or a subscription partly overlapping a strict filter
+			n.metrics.dropped.Inc()
+			slog.Debug("dropping message without a schema ID on a strict topic", "topic", m.Topic)
+			return
+		}
+		if err := n.schemas.ValidateStrict(schemaID, m.Encoding, plain); err != nil {
+			n.metrics.dropped.Inc()
+			slog.Debug("dropping message failing strict validation", "topic", m.Topic, "schema", schemaID, "err", err)
+			return
+		}
+	}
+	msg := Message{
+		Topic:          m.Topic,
+		Payload:        plain,
+		SchemaID:       m.SchemaID,
+		Encoding:       m.Encoding,
+		Retained:       m.Retained,
+		Sender:         &senderPub,
+		ReplyTo:        m.ReplyTo,
+		CorrelationID:  m.CorrelationID,
+		Headers:        headers,
+		RoutingHeaders: m.Headers,
+	}
+	n.metrics.received.Inc()
+	ctx := context.Background()
+	if sc, err := trace.ParseTraceparent(headers[proto.HeaderTraceparent]); err == nil {
+		ctx = trace.ContextWithSpanContext(ctx, sc)
+	}
+	ctx, span := n.tracer.Start(ctx, "receive "+m.Topic, trace.KindConsumer)
+	span.SetAttribute("messaging.system", "qumbed")
+	span.SetAttribute("messaging.destination.name", m.Topic)
+	span.SetAttribute("messaging.message.body.size", len(plain))
+	msg.Trace = trace.SpanContextFromContext(ctx)
+	// replies are matched here, so a Request waiting in OnMessage still gets its reply
+	if n.handleReply(msg) || n.onMsg == nil {
+		span.End()
 		return
 	}
-	if n.onMsg != nil {
-		n.onMsg(m.Topic, plain)
+	n.enqueue(delivery{msg: msg, span: span})
+}
+
+// enqueue hands d to deliverLoop. The receive loop only waits here once deliveryQueue
+// messages are waiting, so it keeps reading the relay's Acks while OnMessage blocks.
+func (n *Node) enqueue(d delivery) {
+	select {
+	case n.deliveries <- d:
+	case <-n.quit:
+		n.metrics.dropped.Inc()
+		d.span.End()
+	}
+}
+
+// deliverLoop passes received messages to OnMessage until Close
+func (n *Node) deliverLoop() {
+	defer close(n.delivered)
+	for {
+		select {
+		case d := <-n.deliveries:
+			n.onMsg(d.msg)
+			d.span.End()
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// isStrict reports whether topic name is validated in strict mode
+func (n *Node) isStrict(name string) bool {
+	if n.strictAll {
+		return true
+	}
+	for _, f := range n.strict {
+		if topic.Match(f, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// strictFilter reports whether the messages a subscription to filter receives are
+// validated in strict mode: all of them, or all those of a strict filter
+func (n *Node) strictFilter(filter string) bool {
+	if n.strictAll {
+		return true
+	}
+	for _, f := range n.strict {
+		if topic.Covers(f, filter) || topic.Covers(filter, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a payload for topic, in strict mode if the topic is configured for it
+func (n *Node) validate(name, schemaID string, enc proto.Encoding, payload []byte) error {
+	if n.isStrict(name) {
+		if schemaID == "" {
+			return fmt.Errorf("topic %q is validated in strict mode: publish needs a schema ID", name)
+		}
+		return n.schemas.ValidateStrict(schemaID, enc, payload)
 	}
+	return n.schemas.ValidateEncoded(schemaID, enc, payload)
+}
+
+// acceptsSchema negotiates versions: a subscriber on sensor.Temperature@1 accepts
+// sensor.Temperature@2 payloads if v1 can read them (see SchemaRegistry.CanRead).
+// With several matching subscriptions, one that can read the writer's schema is enough.
+func (n *Node) acceptsSchema(name, writerID string) bool {
+	if writerID == "" {
+		return true
+	}
+	var readers []string
+	n.subSchemas.Match(name, func(_, _ string, id string) {
+		readers = append(readers, id)
+	})
+	if len(readers) == 0 {
+		return true
+	}
+	var err error
+	for _, readerID := range readers {
+		if readerID == "" || readerID == writerID {
+			return true
+		}
+		if err = n.schemas.CanRead(readerID, writerID); err == nil {
+			return true
+		}
+	}
+	slog.Debug("dropping message with incompatible schema", "topic", name, "schema", writerID, "want", readers, "err", err)
+	return false
+}
+
+// subscribedSchema returns the schema ID of a subscription matching topic name
+func (n *Node) subscribedSchema(name string) string {
+	var id string
+	n.subSchemas.Match(name, func(_, _ string, s string) {
+		if id == "" {
+			id = s
+		}
+	})
+	return id
 }
 
 // Publish sends a message to a topic (E2EE to recipient)
 func (n *Node) Publish(ctx context.Context, topic, schemaID string, payload []byte, recipientPub *[crypto.PublicKeySize]byte) error {
-	if err := proto.ValidatePayload(schemaID, payload); err != nil {
+	return n.PublishWithOptions(ctx, topic, schemaID, payload, recipientPub, PublishOptions{})
+}
+
+// PublishWithOptions is Publish with optional settings (e.g. protobuf encoding).
+// The trace context in ctx (or of the publish span) is sealed as a traceparent header.
+func (n *Node) PublishWithOptions(ctx context.Context, name, schemaID string, payload []byte, recipientPub *[crypto.PublicKeySize]byte, opts PublishOptions) error {
+	ctx, span := n.tracer.Start(ctx, "publish "+name, trace.KindProducer)
+	span.SetAttribute("messaging.system", "qumbed")
+	span.SetAttribute("messaging.destination.name", name)
+	span.SetAttribute("messaging.message.body.size", len(payload))
+	if opts.CorrelationID != "" {
+		span.SetAttribute("messaging.message.conversation_id", opts.CorrelationID)
+	}
+	err := n.publish(ctx, name, schemaID, payload, recipientPub, opts)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+func (n *Node) publish(ctx context.Context, name, schemaID string, payload []byte, recipientPub *[crypto.PublicKeySize]byte, opts PublishOptions) error {
+	if err := topic.ValidateName(name); err != nil {
+		return err
+	}
+	if err := n.validate(name, schemaID, opts.Encoding, payload); err != nil {
 		return err
 	}
-	enc, err := crypto.Seal(payload, recipientPub, n.keys.Private)
+	if tp := trace.SpanContextFromContext(ctx).Traceparent(); tp != "" {
+		opts.Headers = withHeader(opts.Headers, proto.HeaderTraceparent, tp)
+		if n.traceRelay {
+			opts.RoutingHeaders = withHeader(opts.RoutingHeaders, proto.HeaderTraceparent, tp)
+		}
+	}
+	if err := proto.ValidateRoutingHeaders(opts.RoutingHeaders); err != nil {
+		return err
+	}
+	plain := payload
+	if len(opts.Headers) > 0 {
+		var err error
+		if plain, err = proto.MarshalEnvelope(opts.Headers, payload); err != nil {
+			return err
+		}
+	}
+	enc, err := crypto.Seal(plain, recipientPub, n.keys.Private)
 	if err != nil {
 		return err
 	}
 	f := &proto.Frame{
 		Type: proto.FrameTypePublish,
 		Publish: &proto.PublishFrame{
-			Topic:           topic,
+			Topic:           name,
 			Payload:         enc,
 			SchemaID:        schemaID,
 			RecipientKeyID:  crypto.KeyID(recipientPub),
 			SenderPublicKey: n.keys.Public[:],
+			Encoding:        opts.Encoding,
+			Retain:          opts.Retain,
+			ReplyTo:         opts.ReplyTo,
+			CorrelationID:   opts.CorrelationID,
+			Envelope:        len(opts.Headers) > 0,
+			Headers:         opts.RoutingHeaders,
 		},
 	}
+	return n.sendPublish(ctx, f)
+}
 
+// withHeader returns a copy of h with key set, unless h already sets it
+func withHeader(h map[string]string, key, value string) map[string]string {
+	if _, ok := h[key]; ok {
+		return h
+	}
+	out := make(map[string]string, len(h)+1)
+	for k, v := range h {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}
+
+// ClearRetained removes the relay's retained message on topic name for recipientPub,
+// or for every recipient if recipientPub is nil
+func (n *Node) ClearRetained(ctx context.Context, name string, recipientPub *[crypto.PublicKeySize]byte) error {
+	if err := topic.ValidateName(name); err != nil {
+		return err
+	}
+	p := &proto.PublishFrame{Topic: name, Retain: true, SenderPublicKey: n.keys.Public[:]}
+	if recipientPub != nil {
+		p.RecipientKeyID = crypto.KeyID(recipientPub)
+	}
+	return n.sendPublish(ctx, &proto.Frame{Type: proto.FrameTypePublish, Publish: p})
+}
+
+// sendPublish sends a Publish frame to the relay and waits for its Ack
+func (n *Node) sendPublish(ctx context.Context, f *proto.Frame) error {
 	if n.relay != nil {
-		conn, err := transport.DialQUIC(ctx, n.relayAddr)
-		if err != nil {
+		if err := n.relay.Request(ctx, f); err != nil {
+			n.metrics.publishErrors.Inc()
 			return err
 		}
-		defer conn.Close()
-		return conn.SendFrame(f)
+		n.metrics.publishes.Inc()
+		return nil
 	}
 	// P2P: would need to find peer and send
 	return nil
 }
 
-// Subscribe registers for a topic and starts receiving (must keep relay conn open)
-func (n *Node) Subscribe(ctx context.Context, topic, schemaID string) error {
+// Subscribe registers for a topic and starts receiving over the relay session.
+// The topic may be a filter with "+" and "#" wildcards (e.g. "sensors/+/temp", "sensors/#").
+func (n *Node) Subscribe(ctx context.Context, filter, schemaID string) error {
+	return n.SubscribeWithOptions(ctx, filter, schemaID, SubscribeOptions{})
+}
+
+// SubscribeWithOptions is Subscribe with optional settings (e.g. a shared group)
+func (n *Node) SubscribeWithOptions(ctx context.Context, filter, schemaID string, opts SubscribeOptions) error {
+	if err := topic.ValidateFilter(filter); err != nil {
+		return err
+	}
+	if opts.Group != "" {
+		if err := topic.ValidateGroup(opts.Group); err != nil {
+			return err
+		}
+	}
+	// strict messages without a schema ID would have nothing to be validated against;
+	// replies to an inbox carry the replier's schema ID
+	if schemaID == "" && n.strictFilter(filter) && !strings.HasPrefix(filter, InboxTopicPrefix) {
+		return fmt.Errorf("topic %q is validated in strict mode: subscribe needs a schema ID", filter)
+	}
 	if n.relay == nil {
 		return nil
 	}
-	conn, err := transport.DialQUIC(ctx, n.relayAddr)
+	// register the schema first: a persistent session's backlog may arrive before the Ack
+	n.subSchemas.Add(filter, filter, schemaID)
+	err := n.relay.Subscribe(ctx, &proto.SubscribeFrame{
+		Topic:      filter,
+		SchemaID:   schemaID,
+		PublicKey:  n.keys.Public[:],
+		Group:      opts.Group,
+		Persistent: opts.Persistent,
+	})
 	if err != nil {
-		return err
-	}
-	f := &proto.Frame{
-		Type: proto.FrameTypeSubscribe,
-		Subscribe: &proto.SubscribeFrame{
-			Topic:     topic,
-			SchemaID:  schemaID,
-			PublicKey: n.keys.Public[:],
-		},
+		n.subSchemas.Remove(filter, filter)
 	}
-	if err := conn.SendFrame(f); err != nil {
-		conn.Close()
-		return err
-	}
-	n.relayConn = conn
-	n.relayDone = make(chan struct{})
-	go n.relayRecvLoop(ctx, conn)
-	return nil
+	return err
 }
 
-func (n *Node) relayRecvLoop(ctx context.Context, c *transport.Conn) {
-	defer close(n.relayDone)
-	defer c.Close()
-	var f proto.Frame
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		if err := c.RecvFrame(&f); err != nil {
-			slog.Debug("relayRecvLoop: recv ended", "err", err)
-			return
-		}
-		if f.Type == proto.FrameTypeMessage && f.Message != nil {
-			slog.Debug("relayRecvLoop: got message", "topic", f.Message.Topic)
-			n.handleMessage(c, f.Message)
-		}
+// Unsubscribe stops receiving filter (subscribed without a group). For a persistent
+// subscription this also ends the relay-side session queue.
+func (n *Node) Unsubscribe(ctx context.Context, filter string) error {
+	return n.UnsubscribeWithOptions(ctx, filter, SubscribeOptions{})
+}
+
+// UnsubscribeWithOptions undoes SubscribeWithOptions with the same filter and options
+// (e.g. leaving a shared group)
+func (n *Node) UnsubscribeWithOptions(ctx context.Context, filter string, opts SubscribeOptions) error {
+	n.subSchemas.Remove(filter, filter)
+	if n.relay == nil {
+		return nil
 	}
+	return n.relay.Unsubscribe(ctx, filter, opts.Group)
 }
 
 // PublicKey returns the node's public key for E2EE
@@ -268,6 +699,11 @@ func (n *Node) PublicKey() *[crypto.PublicKeySize]byte {
 	return n.keys.Public
 }
 
+// Schemas returns the registry used to validate payloads
+func (n *Node) Schemas() *proto.SchemaRegistry {
+	return n.schemas
+}
+
 // Addr returns the local QUIC listen address
 func (n *Node) Addr() string {
 	return n.server.LocalAddr()
@@ -275,11 +711,8 @@ func (n *Node) Addr() string {
 
 // Close shuts down the node
 func (n *Node) Close() error {
-	if n.relayConn != nil {
-		n.relayConn.Close()
-		if n.relayDone != nil {
-			<-n.relayDone
-		}
+	if n.relay != nil {
+		n.relay.Close()
 	}
 	if n.disc != nil {
 		n.disc.Close()
@@ -287,5 +720,7 @@ func (n *Node) Close() error {
 	if n.server != nil && n.server.Listener != nil {
 		_ = n.server.Listener.Close()
 	}
+	n.closeOnce.Do(func() { close(n.quit) })
+	<-n.delivered
 	return nil
 }
@@ -0,0 +1,58 @@
+package mesh
+
+import (
+	"net/http"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/metrics"
+)
+
+// nodeMetrics are a node's Prometheus metrics, served by Node.Metrics
+type nodeMetrics struct {
+	reg *metrics.Registry
+
+	publishes     *metrics.Counter
+	publishErrors *metrics.Counter
+	received      *metrics.Counter
+	dropped       *metrics.Counter
+}
+
+func newNodeMetrics(n *Node) *nodeMetrics {
+	reg := metrics.NewRegistry()
+	m := &nodeMetrics{
+		reg:           reg,
+		publishes:     reg.Counter("qumbed_node_publishes_total", "Publishes acknowledged by the relay."),
+		publishErrors: reg.Counter("qumbed_node_publish_errors_total", "Publishes that failed (relay error, timeout or connection loss)."),
+		received:      reg.Counter("qumbed_node_messages_received_total", "Messages delivered to the application (including replies)."),
+		dropped:       reg.Counter("qumbed_node_messages_dropped_total", "Messages dropped: undecryptable, unexpected schema or failing strict validation."),
+	}
+	reg.GaugeFunc("qumbed_node_relay_connected", "1 while the relay session is connected.", func() float64 {
+		if n.relay != nil && n.relay.stats().connected {
+			return 1
+		}
+		return 0
+	})
+	reg.CounterFunc("qumbed_node_relay_connects_total", "Relay session connects, including reconnects.", func() float64 {
+		if n.relay == nil {
+			return 0
+		}
+		return float64(n.relay.stats().connects)
+	})
+	reg.CounterFunc("qumbed_node_relay_sent_bytes_total", "Frame bytes written to the relay.", func() float64 {
+		if n.relay == nil {
+			return 0
+		}
+		return float64(n.relay.stats().sent)
+	})
+	reg.CounterFunc("qumbed_node_relay_received_bytes_total", "Frame bytes read from the relay.", func() float64 {
+		if n.relay == nil {
+			return 0
+		}
+		return float64(n.relay.stats().received)
+	})
+	return m
+}
+
+// Metrics serves the node's metrics in the Prometheus text format
+func (n *Node) Metrics() http.Handler {
+	return n.metrics.reg
+}
@@ -0,0 +1,219 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+)
+
+// Rate is a token-bucket limit on publishes. Zero fields are unlimited; bursts of up
+// to one second's worth (at least one message) are allowed.
+type Rate struct {
+	Messages float64 // messages per second
+	Bytes    float64 // payload bytes per second
+}
+
+// ParseRate parses "<messages/s>,<bytes/s>" (e.g. "100,1048576"); either may be 0
+// for unlimited, and the bytes part may be omitted
+func ParseRate(s string) (Rate, error) {
+	var r Rate
+	msgs, bytes, _ := strings.Cut(s, ",")
+	var err error
+	if r.Messages, err = strconv.ParseFloat(strings.TrimSpace(msgs), 64); err != nil || r.Messages < 0 {
+		return Rate{}, fmt.Errorf("rate %q: want <messages/s>,<bytes/s>", s)
+	}
+	if bytes != "" {
+		if r.Bytes, err = strconv.ParseFloat(strings.TrimSpace(bytes), 64); err != nil || r.Bytes < 0 {
+			return Rate{}, fmt.Errorf("rate %q: want <messages/s>,<bytes/s>", s)
+		}
+	}
+	return r, nil
+}
+
+func (r Rate) unlimited() bool { return r.Messages == 0 && r.Bytes == 0 }
+
+// burst is the message capacity of a bucket: one second's worth, but at least one
+// message, so rates below 1/s still let a publish through
+func (r Rate) burst() float64 { return math.Max(1, r.Messages) }
+
+// TopicRate overrides the per-topic limit for topics matching Pattern
+type TopicRate struct {
+	Pattern string
+	Rate    Rate
+}
+
+// RateLimits limits how fast clients may publish. Each Publish must fit the
+// connection's, its identity's and its topic's bucket; otherwise it is refused with
+// RATE_LIMITED and a retry-after hint.
+type RateLimits struct {
+	Connection Rate // per connection
+	Identity   Rate // per identity (authenticated subject, else proven key) across its connections
+	Topic      Rate // per topic, across publishers
+	// Identities overrides Identity by subject (or proven key, hex)
+	Identities map[string]Rate
+	// Topics overrides Topic; the first matching pattern wins
+	Topics []TopicRate
+}
+
+// bucket holds message and byte tokens, refilled continuously at rate
+type bucket struct {
+	mu    sync.Mutex
+	rate  Rate
+	msgs  float64
+	bytes float64
+	last  time.Time
+}
+
+func newBucket(r Rate, now time.Time) *bucket {
+	return &bucket{rate: r, msgs: r.burst(), bytes: r.Bytes, last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	dt := now.Sub(b.last).Seconds()
+	b.last = now
+	b.msgs = math.Min(b.rate.burst(), b.msgs+dt*b.rate.Messages)
+	b.bytes = math.Min(b.rate.Bytes, b.bytes+dt*b.rate.Bytes)
+}
+
+// wait returns how long until a message of size fits; 0 if it fits now. A message
+// larger than the burst fits a full bucket and leaves it in debt.
+func (b *bucket) wait(size float64) time.Duration {
+	var w float64
+	if b.rate.Messages > 0 && b.msgs < 1 {
+		w = (1 - b.msgs) / b.rate.Messages
+	}
+	if need := math.Min(size, b.rate.Bytes); b.rate.Bytes > 0 && b.bytes < need {
+		w = math.Max(w, (need-b.bytes)/b.rate.Bytes)
+	}
+	return time.Duration(w * float64(time.Second))
+}
+
+func (b *bucket) take(size float64) {
+	if b.rate.Messages > 0 {
+		b.msgs--
+	}
+	if b.rate.Bytes > 0 {
+		b.bytes -= size
+	}
+}
+
+func (b *bucket) full() bool {
+	return (b.rate.Messages == 0 || b.msgs >= b.rate.burst()) && b.bytes >= b.rate.Bytes
+}
+
+// rateLimiter keeps the shared identity and topic buckets of a relay
+type rateLimiter struct {
+	cfg RateLimits
+
+	mu         sync.Mutex
+	identities map[string]*bucket
+	topics     map[string]*bucket
+}
+
+func newRateLimiter(cfg RateLimits) *rateLimiter {
+	return &rateLimiter{cfg: cfg, identities: make(map[string]*bucket), topics: make(map[string]*bucket)}
+}
+
+// connBucket returns a bucket for a new connection; nil if connections are unlimited
+func (l *rateLimiter) connBucket() *bucket {
+	if l.cfg.Connection.unlimited() {
+		return nil
+	}
+	return newBucket(l.cfg.Connection, time.Now())
+}
+
+// allow takes tokens for a publish of size bytes from the connection's bucket (may be
+// nil) and the buckets of identity (empty if unknown) and name. It returns 0 if the
+// publish may go ahead, or how long to wait; nothing is taken from any bucket then.
+func (l *rateLimiter) allow(conn *bucket, identity, name string, size int) time.Duration {
+	now := time.Now()
+	buckets := make([]*bucket, 0, 3)
+	if conn != nil {
+		buckets = append(buckets, conn)
+	}
+	l.mu.Lock()
+	if identity != "" {
+		if b := l.shared(l.identities, identity, l.identityRate(identity), now); b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+	if b := l.shared(l.topics, name, l.topicRate(name), now); b != nil {
+		buckets = append(buckets, b)
+	}
+	l.mu.Unlock()
+
+	// always locked in the same order (connection, identity, topic)
+	var wait time.Duration
+	for _, b := range buckets {
+		b.mu.Lock()
+		b.refill(now)
+		wait = max(wait, b.wait(float64(size)))
+	}
+	for _, b := range buckets {
+		if wait == 0 {
+			b.take(float64(size))
+		}
+		b.mu.Unlock()
+	}
+	return wait
+}
+
+// shared returns the bucket for key, creating it; nil if rate is unlimited. l.mu is held.
+func (l *rateLimiter) shared(m map[string]*bucket, key string, rate Rate, now time.Time) *bucket {
+	if rate.unlimited() {
+		return nil
+	}
+	b := m[key]
+	if b == nil {
+		b = newBucket(rate, now)
+		m[key] = b
+	}
+	return b
+}
+
+func (l *rateLimiter) identityRate(identity string) Rate {
+	if r, ok := l.cfg.Identities[identity]; ok {
+		return r
+	}
+	return l.cfg.Identity
+}
+
+func (l *rateLimiter) topicRate(name string) Rate {
+	for _, t := range l.cfg.Topics {
+		if topic.Match(t.Pattern, name) {
+			return t.Rate
+		}
+	}
+	return l.cfg.Topic
+}
+
+// sweep drops idle (refilled) identity and topic buckets every interval
+func (l *rateLimiter) sweep(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			l.mu.Lock()
+			for _, m := range []map[string]*bucket{l.identities, l.topics} {
+				for k, b := range m {
+					b.mu.Lock()
+					b.refill(now)
+					if b.full() {
+						delete(m, k)
+					}
+					b.mu.Unlock()
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
@@ -1,12 +1,486 @@
 package mesh
 
-// Relay forwards messages without storing or reading payload (zero-knowledge).
-// It only sees topic and recipient key ID for routing; no persistence or queue.
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
+	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+	"github.com/SWAI-Ltd/Qumbed/internal/transport"
+)
+
+// Relay is a node's session with a relay server: one QUIC connection, opened on
+// first use with a Connect proving the node's key, and re-established (with its
+// subscriptions) if it drops. The relay forwards messages without reading payload
+// (zero-knowledge); it only sees topic and recipient key ID for routing.
 type Relay struct {
-	addr string
+	addr  string
+	tls   *tls.Config         // nil skips relay certificate verification (development)
+	hello *proto.ConnectFrame // sent on every connect; replaced, not modified, by SetToken
+	keys  *crypto.KeyPair
+	onMsg func(*proto.MessageFrame)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wmu serializes connects and writes, so waiters queue in the order their frames
+	// are sent; mu is only held briefly and never while dialing or sending
+	wmu sync.Mutex
+
+	mu      sync.Mutex // guards the fields below
+	conn    *transport.Conn
+	done    chan struct{}                     // closed when conn's receive loop exits
+	waiters map[*transport.Conn][]chan error  // callers awaiting the relay's Ack/Error, per connection in send order
+	leaving map[*transport.Conn]chan struct{} // connections told to go away -> their receive loop's done
+	subs    map[string]*proto.SubscribeFrame  // filter + group -> Subscribe, replayed on reconnect
+	closed  bool
+
+	connects                   atomic.Uint64
+	closedSent, closedReceived atomic.Uint64 // frame bytes of earlier connections
+}
+
+// relayStats is a snapshot of the session's counters
+type relayStats struct {
+	connected      bool
+	connects       uint64
+	sent, received uint64
+}
+
+// ErrRelayClosed is returned when using a relay session after Close
+var ErrRelayClosed = errors.New("relay session closed")
+
+// errConnLost is returned to requests whose connection dropped before the relay answered
+var errConnLost = errors.New("relay connection lost")
+
+// RelayError is an Error frame returned by the relay (e.g. SCHEMA_INVALID, TOPIC_INVALID)
+type RelayError struct {
+	Code       string
+	Message    string
+	RetryAfter time.Duration // RATE_LIMITED: how long to wait before retrying
+}
+
+func relayError(e *proto.ErrorFrame) *RelayError {
+	return &RelayError{Code: e.Code, Message: e.Message, RetryAfter: time.Duration(e.RetryAfterMs) * time.Millisecond}
+}
+
+func (e *RelayError) Error() string {
+	return fmt.Sprintf("relay: %s: %s", e.Code, e.Message)
+}
+
+// NewRelay creates a relay session (connects on demand). hello is the Connect sent for
+// keys on every connect (with the node ID, credentials, will and presence); onMsg
+// receives Message frames.
+func NewRelay(addr string, tlsCfg *tls.Config, hello *proto.ConnectFrame, keys *crypto.KeyPair, onMsg func(*proto.MessageFrame)) *Relay {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Relay{
+		addr:    addr,
+		tls:     tlsCfg,
+		hello:   hello,
+		keys:    keys,
+		onMsg:   onMsg,
+		ctx:     ctx,
+		cancel:  cancel,
+		subs:    make(map[string]*proto.SubscribeFrame),
+		waiters: make(map[*transport.Conn][]chan error),
+		leaving: make(map[*transport.Conn]chan struct{}),
+	}
+}
+
+// Request sends f and waits for the relay's Ack; an Error frame is returned as *RelayError
+func (r *Relay) Request(ctx context.Context, f *proto.Frame) error {
+	if err := r.connect(ctx); err != nil {
+		return err
+	}
+	ch := make(chan error, 1)
+	r.wmu.Lock()
+	r.mu.Lock()
+	c := r.conn
+	if c != nil {
+		// queued before sending, as the Ack may arrive before SendFrame returns
+		r.waiters[c] = append(r.waiters[c], ch)
+	}
+	r.mu.Unlock()
+	if c == nil {
+		r.wmu.Unlock()
+		return errConnLost
+	}
+	err := c.SendFrame(f)
+	r.wmu.Unlock()
+	if err != nil {
+		c.Close() // the receive loop fails the waiters and reconnects
+		return err
+	}
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send sends a frame the relay does not answer (e.g. Unsubscribe)
+func (r *Relay) Send(ctx context.Context, f *proto.Frame) error {
+	if err := r.connect(ctx); err != nil {
+		return err
+	}
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+	r.mu.Lock()
+	c := r.conn
+	r.mu.Unlock()
+	if c == nil {
+		return errConnLost
+	}
+	return c.SendFrame(f)
+}
+
+// Subscribe sends a Subscribe and remembers it, so it is renewed after a reconnect
+func (r *Relay) Subscribe(ctx context.Context, s *proto.SubscribeFrame) error {
+	if err := r.Request(ctx, &proto.Frame{Type: proto.FrameTypeSubscribe, Subscribe: s}); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.subs[s.Topic+"\x00"+s.Group] = s
+	r.mu.Unlock()
+	return nil
+}
+
+// Unsubscribe forgets a subscription and tells the relay
+func (r *Relay) Unsubscribe(ctx context.Context, filter, group string) error {
+	r.mu.Lock()
+	delete(r.subs, filter+"\x00"+group)
+	r.mu.Unlock()
+	return r.Send(ctx, &proto.Frame{Type: proto.FrameTypeUnsubscribe, Unsubscribe: &proto.UnsubscribeFrame{Topic: filter, Group: group}})
+}
+
+// SetToken replaces the bearer token: it is used for later connects and, if the
+// session is open, sent to the relay in an Auth frame
+func (r *Relay) SetToken(ctx context.Context, token string) error {
+	r.wmu.Lock() // a connect in progress finishes with the old token, then gets an Auth
+	r.mu.Lock()
+	hello := *r.hello
+	hello.Token = token
+	r.hello = &hello
+	connected := r.conn != nil
+	r.mu.Unlock()
+	r.wmu.Unlock()
+	if !connected {
+		return nil
+	}
+	err := r.Request(ctx, &proto.Frame{Type: proto.FrameTypeAuth, Auth: &proto.AuthFrame{Token: token}})
+	if errors.Is(err, errConnLost) {
+		return nil // the reconnect sends the new token
+	}
+	return err
+}
+
+// refreshTokens keeps a JWT bearer token fresh: when 80% of its remaining lifetime
+// has passed, it fetches a new one from source and hands it to SetToken
+func (r *Relay) refreshTokens(source func(context.Context) (string, error)) {
+	retry := time.Second
+	for {
+		r.mu.Lock()
+		exp := tokenExpiry(r.hello.Token)
+		r.mu.Unlock()
+		if exp.IsZero() {
+			return // not a JWT, or it does not expire
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(time.Until(exp) * 4 / 5):
+		}
+		ctx, cancel := context.WithTimeout(r.ctx, 10*time.Second)
+		token, err := source(ctx)
+		if err == nil {
+			err = r.SetToken(ctx, token)
+		}
+		cancel()
+		if err == nil {
+			retry = time.Second
+			continue
+		}
+		slog.Warn("relay session: token refresh failed", "err", err, "expires", exp)
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		if retry < 30*time.Second {
+			retry *= 2
+		}
+	}
+}
+
+// connect opens the session if it is not open
+func (r *Relay) connect(ctx context.Context) error {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+	r.mu.Lock()
+	closed, open, hello := r.closed, r.conn != nil, r.hello
+	r.mu.Unlock()
+	if closed {
+		return ErrRelayClosed
+	}
+	if open {
+		return nil
+	}
+	c, err := transport.DialQUICWithTLS(ctx, r.addr, r.tls)
+	if err != nil {
+		return err
+	}
+	if err := r.handshake(ctx, c, hello); err != nil {
+		c.Close()
+		return err
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		c.Close()
+		return ErrRelayClosed
+	}
+	r.conn = c
+	r.connects.Add(1)
+	r.done = make(chan struct{})
+	done := r.done
+	// renew subscriptions after a reconnect; their replies are matched like any request
+	renew := make([]*proto.SubscribeFrame, 0, len(r.subs))
+	for _, s := range r.subs {
+		renew = append(renew, s)
+		r.waiters[c] = append(r.waiters[c], make(chan error, 1))
+	}
+	r.mu.Unlock()
+	go r.recvLoop(c, done)
+	for _, s := range renew {
+		if err := c.SendFrame(&proto.Frame{Type: proto.FrameTypeSubscribe, Subscribe: s}); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// handshake proves possession of the node's private key: Connect, then answer the
+// relay's Challenge with a Prove and wait for its Ack
+func (r *Relay) handshake(ctx context.Context, c *transport.Conn, hello *proto.ConnectFrame) error {
+	if err := c.SendFrame(&proto.Frame{Type: proto.FrameTypeConnect, Connect: hello}); err != nil {
+		return err
+	}
+	var f proto.Frame
+	if err := recvFrame(ctx, c, &f); err != nil {
+		return err
+	}
+	if f.Type == proto.FrameTypeError && f.Error != nil {
+		return relayError(f.Error)
+	}
+	ch := f.Challenge
+	if f.Type != proto.FrameTypeChallenge || ch == nil || len(ch.PublicKey) != crypto.PublicKeySize {
+		return fmt.Errorf("relay: unexpected reply to Connect (frame type %d)", f.Type)
+	}
+	var verifier [crypto.PublicKeySize]byte
+	copy(verifier[:], ch.PublicKey)
+	proof, err := crypto.Prove(ch.Nonce, &verifier, r.keys.Private)
+	if err != nil {
+		return err
+	}
+	if err := c.SendFrame(&proto.Frame{Type: proto.FrameTypeProve, Prove: &proto.ProveFrame{Proof: proof}}); err != nil {
+		return err
+	}
+	return awaitAck(ctx, c)
+}
+
+func (r *Relay) recvLoop(c *transport.Conn, done chan struct{}) {
+	defer close(done)
+	var err error
+	for {
+		var f proto.Frame
+		if err = c.RecvFrame(&f); err != nil {
+			break
+		}
+		switch f.Type {
+		case proto.FrameTypeMessage:
+			if f.Message != nil && r.onMsg != nil {
+				r.onMsg(f.Message)
+			}
+		case proto.FrameTypeAck:
+			r.reply(c, nil)
+		case proto.FrameTypeError:
+			if e := f.Error; e != nil {
+				r.reply(c, relayError(e))
+			}
+		case proto.FrameTypeGoAway:
+			if g := f.GoAway; g != nil {
+				r.goAway(c, g.Reason)
+			}
+		}
+	}
+	slog.Debug("relay session: recv ended", "err", err)
+	r.mu.Lock()
+	r.closedSent.Add(c.BytesSent())
+	r.closedReceived.Add(c.BytesReceived())
+	for _, w := range r.waiters[c] {
+		w <- errConnLost
+	}
+	delete(r.waiters, c)
+	delete(r.leaving, c)
+	current := r.conn == c
+	if current {
+		r.conn = nil
+	}
+	closed := r.closed
+	r.mu.Unlock()
+	c.Close()
+	if current && !closed {
+		go r.reconnect()
+	}
+}
+
+// goAway moves the session off a relay that is shutting down: new requests open a
+// new connection (to another relay behind the same address, or this one once it is
+// back), and c is closed as soon as the requests already sent on it are answered
+func (r *Relay) goAway(c *transport.Conn, reason string) {
+	slog.Info("relay session: relay is going away, reconnecting", "addr", r.addr, "reason", reason)
+	r.mu.Lock()
+	if r.conn != c {
+		r.mu.Unlock()
+		return
+	}
+	r.conn = nil
+	r.leaving[c] = r.done
+	idle := len(r.waiters[c]) == 0
+	closed := r.closed
+	r.mu.Unlock()
+	if idle {
+		c.Close()
+	}
+	if !closed {
+		go r.reconnect()
+	}
+}
+
+func (r *Relay) stats() relayStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := relayStats{connected: r.conn != nil, connects: r.connects.Load(), sent: r.closedSent.Load(), received: r.closedReceived.Load()}
+	for c := range r.waiters {
+		s.sent += c.BytesSent()
+		s.received += c.BytesReceived()
+	}
+	return s
+}
+
+// reply hands the relay's answer on c to the oldest request waiting on it; a
+// connection that was told to go away is closed after its last answer
+func (r *Relay) reply(c *transport.Conn, err error) {
+	r.mu.Lock()
+	ws := r.waiters[c]
+	if len(ws) == 0 {
+		r.mu.Unlock()
+		if err != nil {
+			slog.Debug("relay session: unsolicited error", "err", err)
+		}
+		return
+	}
+	ws[0] <- err
+	r.waiters[c] = ws[1:]
+	_, leaving := r.leaving[c]
+	r.mu.Unlock()
+	if leaving && len(ws) == 1 {
+		c.Close()
+	}
+}
+
+// reconnect re-establishes a dropped session with exponential backoff
+func (r *Relay) reconnect() {
+	backoff := 100 * time.Millisecond
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		ctx, cancel := context.WithTimeout(r.ctx, 10*time.Second)
+		err := r.connect(ctx)
+		cancel()
+		if err == nil || errors.Is(err, ErrRelayClosed) {
+			return
+		}
+		slog.Debug("relay session: reconnect failed", "addr", r.addr, "err", err)
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// Close ends the session cleanly (the relay discards the will) and stops reconnecting
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	connected := r.conn != nil
+	r.mu.Unlock()
+	if connected {
+		ctx, cancel := context.WithTimeout(r.ctx, 2*time.Second)
+		if err := r.Request(ctx, &proto.Frame{Type: proto.FrameTypeDisconnect, Disconnect: &proto.DisconnectFrame{}}); err != nil {
+			slog.Debug("relay session: disconnect failed", "err", err)
+		}
+		cancel()
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.cancel()
+	c, done := r.conn, r.done
+	leaving := make(map[*transport.Conn]chan struct{}, len(r.leaving))
+	for lc, ld := range r.leaving {
+		leaving[lc] = ld
+	}
+	r.mu.Unlock()
+	for lc, ld := range leaving {
+		lc.Close()
+		<-ld
+	}
+	if c == nil {
+		return nil
+	}
+	err := c.Close()
+	<-done
+	return err
+}
+
+// recvFrame reads one frame, giving up when ctx is done
+func recvFrame(ctx context.Context, c *transport.Conn, f *proto.Frame) error {
+	stop := context.AfterFunc(ctx, func() { c.Stream.SetReadDeadline(time.Now()) })
+	defer stop()
+	if err := c.RecvFrame(f); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
 }
 
-// NewRelay creates a relay reference (connects on demand)
-func NewRelay(addr string) *Relay {
-	return &Relay{addr: addr}
+// awaitAck waits for the relay's reply to the last frame sent on c; an Error frame
+// is returned as *RelayError. ctx bounds the wait.
+func awaitAck(ctx context.Context, c *transport.Conn) error {
+	var f proto.Frame
+	if err := recvFrame(ctx, c, &f); err != nil {
+		return err
+	}
+	if f.Type == proto.FrameTypeError && f.Error != nil {
+		return relayError(f.Error)
+	}
+	return nil
 }
@@ -0,0 +1,226 @@
+package mesh
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+)
+
+// ConnectionInfo describes an open relay connection
+type ConnectionInfo struct {
+	RemoteAddr    string    `json:"remote_addr"` // identifies the connection, e.g. for Kick
+	NodeID        string    `json:"node_id,omitempty"`
+	KeyID         string    `json:"key_id,omitempty"`  // hex; empty until the client proved its key
+	Subject       string    `json:"subject,omitempty"` // authenticated identity, if any
+	ConnectedAt   time.Time `json:"connected_at"`
+	Queued        int       `json:"queued"` // messages waiting in its send queue
+	BytesSent     uint64    `json:"bytes_sent"`
+	BytesReceived uint64    `json:"bytes_received"`
+}
+
+// TopicInfo is a subscription filter and how many connections subscribe with it
+type TopicInfo struct {
+	Filter      string `json:"filter"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// RetainedInfo is a topic with retained messages
+type RetainedInfo struct {
+	Topic      string `json:"topic"`
+	Recipients int    `json:"recipients"` // retained messages, one per recipient key
+	Bytes      int    `json:"bytes"`      // ciphertext retained for the topic
+}
+
+// track records an accepted connection for Connections. r.mu is held.
+func (r *RelayServer) track(cs *connState) {
+	r.conns[cs.key] = &ConnectionInfo{RemoteAddr: cs.key, ConnectedAt: time.Now()}
+}
+
+// identify records the proven key and identity of a connection for Connections
+func (r *RelayServer) identify(cs *connState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := r.conns[cs.key]
+	if info == nil {
+		return
+	}
+	info.NodeID = cs.nodeID
+	if len(cs.identity) == crypto.PublicKeySize {
+		var k [crypto.PublicKeySize]byte
+		copy(k[:], cs.identity)
+		info.KeyID = hex.EncodeToString(crypto.KeyID(&k))
+	}
+	if cs.auth != nil {
+		info.Subject = cs.auth.Subject
+	}
+}
+
+// Connections lists the open connections, oldest first
+func (r *RelayServer) Connections() []ConnectionInfo {
+	r.mu.Lock()
+	out := make([]ConnectionInfo, 0, len(r.conns))
+	for key, info := range r.conns {
+		ci := *info
+		if o := r.outboxes[key]; o != nil {
+			ci.Queued = len(o.queue)
+			ci.BytesSent, ci.BytesReceived = o.c.BytesSent(), o.c.BytesReceived()
+		}
+		out = append(out, ci)
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// Kick closes the connection from remoteAddr as if it had dropped: its will, if any,
+// is published. It reports whether the connection was open.
+func (r *RelayServer) Kick(remoteAddr string) bool {
+	r.mu.Lock()
+	o := r.outboxes[remoteAddr]
+	r.mu.Unlock()
+	if o == nil {
+		return false
+	}
+	slog.Info("relay: kicking connection", "remote", remoteAddr)
+	o.close()
+	o.c.Close()
+	return true
+}
+
+// Topics lists the subscription filters with their number of subscribers (shared
+// group members counted individually)
+func (r *RelayServer) Topics() []TopicInfo {
+	counts := r.subs.Counts()
+	out := make([]TopicInfo, 0, len(counts))
+	for f, n := range counts {
+		out = append(out, TopicInfo{Filter: f, Subscribers: n})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Filter < out[j].Filter })
+	return out
+}
+
+// Retained lists the topics with retained messages
+func (r *RelayServer) Retained() []RetainedInfo {
+	r.retainMu.RLock()
+	out := make([]RetainedInfo, 0, len(r.retained))
+	for name, byKey := range r.retained {
+		ri := RetainedInfo{Topic: name, Recipients: len(byKey)}
+		for _, m := range byKey {
+			ri.Bytes += len(m.EncryptedPayload)
+		}
+		out = append(out, ri)
+	}
+	r.retainMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Topic < out[j].Topic })
+	return out
+}
+
+// PurgeRetained removes the retained messages of every topic matching filter ("#"
+// for all) and returns the number of topics purged
+func (r *RelayServer) PurgeRetained(filter string) (int, error) {
+	if err := topic.ValidateFilter(filter); err != nil {
+		return 0, err
+	}
+	r.retainMu.Lock()
+	defer r.retainMu.Unlock()
+	n := 0
+	for name := range r.retained {
+		if topic.Match(filter, name) {
+			delete(r.retained, name)
+			n++
+		}
+	}
+	if n > 0 {
+		slog.Info("relay: purged retained messages", "filter", filter, "topics", n)
+	}
+	return n, nil
+}
+
+// AdminHandler serves the admin API. Every request must carry
+// "Authorization: Bearer <token>"; with an empty token every request is refused.
+//
+//	GET    /connections               open connections
+//	DELETE /connections/{remote_addr} close a connection
+//	GET    /topics                    subscription filters and subscriber counts
+//	GET    /retained                  topics with retained messages
+//	DELETE /retained?filter=<filter>  purge retained messages matching filter
+//	GET    /log-level                 current log level
+//	PUT    /log-level                 set it: {"level":"debug"} (needs RelayConfig.LogLevel)
+func (r *RelayServer) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, r.Connections())
+	})
+	mux.HandleFunc("DELETE /connections/{addr}", func(w http.ResponseWriter, req *http.Request) {
+		if !r.Kick(req.PathValue("addr")) {
+			writeError(w, http.StatusNotFound, errors.New("no such connection"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /topics", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, r.Topics())
+	})
+	mux.HandleFunc("GET /retained", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, r.Retained())
+	})
+	mux.HandleFunc("DELETE /retained", func(w http.ResponseWriter, req *http.Request) {
+		n, err := r.PurgeRetained(req.URL.Query().Get("filter"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+	})
+	mux.HandleFunc("GET /log-level", func(w http.ResponseWriter, _ *http.Request) {
+		if r.cfg.LogLevel == nil {
+			writeError(w, http.StatusNotImplemented, errors.New("log level is not adjustable"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"level": r.cfg.LogLevel.Level().String()})
+	})
+	mux.HandleFunc("PUT /log-level", func(w http.ResponseWriter, req *http.Request) {
+		if r.cfg.LogLevel == nil {
+			writeError(w, http.StatusNotImplemented, errors.New("log level is not adjustable"))
+			return
+		}
+		var body struct {
+			Level slog.Level `json:"level"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1024)).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		r.cfg.LogLevel.Set(body.Level)
+		slog.Warn("relay: log level changed", "level", body.Level)
+		writeJSON(w, http.StatusOK, map[string]string{"level": body.Level.String()})
+	})
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got := []byte(req.Header.Get("Authorization"))
+		if token == "" || subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="qumbed-relay"`)
+			writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
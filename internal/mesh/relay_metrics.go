@@ -0,0 +1,133 @@
+package mesh
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/metrics"
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+)
+
+// relayMetrics are the relay's Prometheus metrics, served by RelayServer.Metrics
+type relayMetrics struct {
+	reg *metrics.Registry
+
+	connections   *metrics.Gauge
+	accepted      *metrics.Counter
+	publishes     *metrics.Counter
+	forwards      *metrics.Counter
+	forwardErrors *metrics.Counter
+	sessionQueued *metrics.Counter
+	decodeErrors  *metrics.Counter
+	authFailures  *metrics.Counter
+	rateLimited   *metrics.Counter
+	forbidden     *metrics.Counter
+	handshake     *metrics.Histogram
+
+	// frame bytes of closed connections; open ones are added when scraped
+	closedSent, closedReceived atomic.Uint64
+}
+
+func newRelayMetrics(r *RelayServer) *relayMetrics {
+	reg := metrics.NewRegistry()
+	m := &relayMetrics{
+		reg:           reg,
+		connections:   reg.Gauge("qumbed_relay_connections", "Open client connections."),
+		accepted:      reg.Counter("qumbed_relay_connections_total", "Client connections accepted."),
+		publishes:     reg.Counter("qumbed_relay_publishes_total", "Publish frames accepted."),
+		forwards:      reg.Counter("qumbed_relay_forwards_total", "Messages handed to subscriber connections."),
+		forwardErrors: reg.Counter("qumbed_relay_forward_errors_total", "Messages that could not be handed to a subscriber (queue full or connection closed)."),
+		sessionQueued: reg.Counter("qumbed_relay_session_queued_total", "Messages queued for offline persistent sessions."),
+		decodeErrors:  reg.Counter("qumbed_relay_frame_decode_errors_total", "Frames that were too large or not valid JSON; the connection is closed."),
+		authFailures:  reg.Counter("qumbed_relay_auth_failures_total", "Failed key proofs and authentications."),
+		rateLimited:   reg.Counter("qumbed_relay_rate_limited_total", "Publishes refused with RATE_LIMITED."),
+		forbidden:     reg.Counter("qumbed_relay_forbidden_total", "Publishes and subscriptions refused with FORBIDDEN."),
+		handshake:     reg.Histogram("qumbed_relay_handshake_seconds", "Time from Connect to a verified (and authenticated) Prove.", metrics.DefBuckets),
+	}
+	reg.CounterFunc("qumbed_relay_received_bytes_total", "Frame bytes read from clients.", func() float64 {
+		return float64(m.closedReceived.Load() + r.liveBytes(false))
+	})
+	reg.CounterFunc("qumbed_relay_sent_bytes_total", "Frame bytes written to clients.", func() float64 {
+		return float64(m.closedSent.Load() + r.liveBytes(true))
+	})
+	reg.GaugeVecFunc("qumbed_relay_subscriptions", "Subscriptions by first level of the topic filter, for the most subscribed roots; the rest are counted under \"other\".", "root", func() map[string]float64 {
+		return subscriptionsByRoot(r.subs.Counts(), maxSubscriptionRoots)
+	})
+	reg.GaugeFunc("qumbed_relay_sessions", "Persistent sessions, online and offline.", func() float64 {
+		r.sessMu.Lock()
+		defer r.sessMu.Unlock()
+		return float64(len(r.sessions))
+	})
+	reg.GaugeFunc("qumbed_relay_retained_topics", "Topics with a retained message.", func() float64 {
+		r.retainMu.RLock()
+		defer r.retainMu.RUnlock()
+		return float64(len(r.retained))
+	})
+	reg.GaugeFunc("qumbed_relay_send_queue_depth", "Messages waiting in connection send queues.", func() float64 {
+		return float64(r.QueueStats().Queued)
+	})
+	reg.GaugeFunc("qumbed_relay_send_queue_max_depth", "Messages waiting in the fullest connection send queue.", func() float64 {
+		return float64(r.QueueStats().MaxDepth)
+	})
+	reg.CounterFunc("qumbed_relay_send_queue_dropped_total", "Messages dropped because a send queue was full.", func() float64 {
+		return float64(r.queueStats.dropped.Load())
+	})
+	reg.CounterFunc("qumbed_relay_slow_consumer_disconnects_total", "Connections closed because their send queue was full.", func() float64 {
+		return float64(r.queueStats.disconnected.Load())
+	})
+	return m
+}
+
+// liveBytes sums the frame bytes sent (or received) on open connections
+func (r *RelayServer) liveBytes(sent bool) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n uint64
+	for _, o := range r.outboxes {
+		if sent {
+			n += o.c.BytesSent()
+		} else {
+			n += o.c.BytesReceived()
+		}
+	}
+	return n
+}
+
+// Metrics serves the relay's metrics in the Prometheus text format
+func (r *RelayServer) Metrics() http.Handler {
+	return r.metrics.reg
+}
+
+// maxSubscriptionRoots bounds the root label of qumbed_relay_subscriptions: filters
+// come from clients, so labelling them as sent would let any client create series
+const maxSubscriptionRoots = 20
+
+// subscriptionsByRoot sums subscription counts per first filter level ("sensors" for
+// "sensors/+/temp") and keeps the max largest, folding the rest into "other"
+func subscriptionsByRoot(counts map[string]int, max int) map[string]float64 {
+	roots := make(map[string]int)
+	for f, n := range counts {
+		root, _, _ := strings.Cut(f, topic.Separator)
+		roots[root] += n
+	}
+	names := make([]string, 0, len(roots))
+	for root := range roots {
+		names = append(names, root)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if roots[names[i]] != roots[names[j]] {
+			return roots[names[i]] > roots[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	out := make(map[string]float64)
+	for i, root := range names {
+		if i >= max {
+			root = "other"
+		}
+		out[root] += float64(roots[names[i]])
+	}
+	return out
+}
@@ -0,0 +1,200 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+	"github.com/SWAI-Ltd/Qumbed/internal/transport"
+)
+
+// DefaultSendQueue is the number of messages queued per relay connection by default
+const DefaultSendQueue = 256
+
+// OverflowPolicy is what the relay does when a connection's send queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowDrop discards the message for that connection (default). A shared
+	// group passes it to the next member.
+	OverflowDrop OverflowPolicy = iota
+	// OverflowDisconnect closes the slow connection
+	OverflowDisconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDrop:
+		return "drop"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy parses "drop" or "disconnect"
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "", "drop":
+		return OverflowDrop, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q (want drop or disconnect)", s)
+}
+
+var (
+	errQueueFull    = errors.New("send queue full")
+	errOutboxClosed = errors.New("connection closed")
+)
+
+// QueueStats describes the relay's per-connection send queues
+type QueueStats struct {
+	Connections  int    // open connections
+	Queued       int    // messages waiting across all queues
+	MaxDepth     int    // messages waiting in the fullest queue
+	Capacity     int    // size of each queue
+	Dropped      uint64 // messages dropped because a queue was full, since start
+	Disconnected uint64 // connections closed as slow consumers, since start
+}
+
+// outbox is a connection's bounded queue of Message frames, written to the
+// connection by its own goroutine so a slow subscriber does not hold up publishers
+type outbox struct {
+	c      *transport.Conn
+	key    string
+	queue  chan *proto.Frame
+	policy OverflowPolicy
+	stats  *queueCounters
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	goAwayOnce sync.Once
+	goAwayCh   chan struct{}
+	grace      time.Duration // set before goAwayCh is closed
+}
+
+// queueCounters are the relay-wide overflow counters
+type queueCounters struct {
+	dropped      atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+func newOutbox(c *transport.Conn, key string, size int, policy OverflowPolicy, stats *queueCounters) *outbox {
+	o := &outbox{c: c, key: key, queue: make(chan *proto.Frame, size), policy: policy, stats: stats, closed: make(chan struct{}), goAwayCh: make(chan struct{})}
+	go o.run()
+	return o
+}
+
+// send queues f without waiting; if the queue is full it applies the overflow policy
+// and returns errQueueFull. It returns errOutboxClosed once the connection is closing.
+func (o *outbox) send(f *proto.Frame) error {
+	select {
+	case o.queue <- f:
+		return nil
+	case <-o.closed:
+		return errOutboxClosed
+	default:
+	}
+	if o.policy == OverflowDisconnect {
+		o.stats.disconnected.Add(1)
+		slog.Warn("relay: disconnecting slow consumer", "remote", o.key, "queued", len(o.queue))
+		o.close()
+		o.c.Close()
+	} else {
+		o.stats.dropped.Add(1)
+		slog.Debug("relay: send queue full, message dropped", "remote", o.key)
+	}
+	return errQueueFull
+}
+
+// push queues f, waiting for room; used for backlogs the client asked for (retained
+// messages, persistent session queues), which may exceed the queue size
+func (o *outbox) push(f *proto.Frame) error {
+	select {
+	case o.queue <- f:
+		return nil
+	case <-o.closed:
+		return errOutboxClosed
+	}
+}
+
+// goAway has the writer send a GoAway after the frames already queued, then close
+// the connection if the client has not hung up within grace
+func (o *outbox) goAway(grace time.Duration) {
+	o.goAwayOnce.Do(func() {
+		o.grace = grace
+		close(o.goAwayCh)
+	})
+}
+
+func (o *outbox) run() {
+	goAway := o.goAwayCh
+	var deadline <-chan time.Time
+	for {
+		select {
+		case f := <-o.queue:
+			if !o.write(f) {
+				return
+			}
+		case <-goAway:
+			goAway = nil
+			for n := len(o.queue); n > 0; n-- {
+				if !o.write(<-o.queue) {
+					return
+				}
+			}
+			if !o.write(goAwayFrame) {
+				return
+			}
+			t := time.NewTimer(o.grace)
+			defer t.Stop()
+			deadline = t.C
+		case <-deadline:
+			slog.Debug("relay: closing connection after GoAway", "remote", o.key)
+			o.close()
+			o.c.Close()
+			return
+		case <-o.closed:
+			return
+		}
+	}
+}
+
+func (o *outbox) write(f *proto.Frame) bool {
+	if err := o.c.SendFrame(f); err != nil {
+		slog.Debug("relay: send failed", "remote", o.key, "err", err)
+		o.close()
+		o.c.Close() // the receive loop ends and removes the connection
+		return false
+	}
+	return true
+}
+
+// close stops the writer; queued messages are discarded
+func (o *outbox) close() {
+	o.closeOnce.Do(func() { close(o.closed) })
+}
+
+// QueueStats reports the depth of the send queues
+func (r *RelayServer) QueueStats() QueueStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := QueueStats{
+		Connections:  len(r.outboxes),
+		Capacity:     r.cfg.SendQueue,
+		Dropped:      r.queueStats.dropped.Load(),
+		Disconnected: r.queueStats.disconnected.Load(),
+	}
+	for _, o := range r.outboxes {
+		n := len(o.queue)
+		s.Queued += n
+		s.MaxDepth = max(s.MaxDepth, n)
+	}
+	return s
+}
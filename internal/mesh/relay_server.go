@@ -1,102 +1,954 @@
 package mesh
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
 	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+	"github.com/SWAI-Ltd/Qumbed/internal/trace"
 	"github.com/SWAI-Ltd/Qumbed/internal/transport"
 )
 
-// RelayServer is a zero-knowledge relay: forwards by topic, never stores or reads payload
+// RelayServer is a zero-knowledge relay: forwards by topic, never reads payload.
+// The only state it keeps is ciphertext: retained messages and the queues of
+// offline persistent sessions.
 type RelayServer struct {
-	server *transport.Server
-	subs   sync.Map // topic -> map[connKey]subscriberInfo
+	server  *transport.Server
+	cfg     RelayConfig
+	ctx     context.Context
+	subs    *topic.Trie[subKey, *subInfo] // filter -> (connKey, group) -> subscriber
+	limits  *rateLimiter
+	metrics *relayMetrics
+	tracer  *trace.Tracer
+
+	queueStats queueCounters
+
+	mu       sync.Mutex
+	next     map[string]int             // shared group (group + filter) -> round-robin position
+	presence map[string]int             // node ID -> connections announcing its presence
+	outboxes map[string]*outbox         // connection key -> send queue
+	conns    map[string]*ConnectionInfo // connection key -> description for Connections
+	closing  bool                       // set by Shutdown
+
+	retainMu sync.RWMutex
+	retained map[string]map[string]*proto.MessageFrame // topic -> recipient key ID (hex) -> last retained message
+
+	sessMu      sync.Mutex
+	sessions    map[string]*session           // public key (hex) -> persistent session
+	sessFilters *topic.Trie[string, *session] // filter -> public key (hex) -> session
+}
+
+// RelayConfig configures a relay server
+type RelayConfig struct {
+	Addr string
+	// SessionMaxBytes caps the ciphertext queued per offline persistent session;
+	// the oldest messages are dropped first. 0 uses DefaultSessionMaxBytes.
+	SessionMaxBytes int
+	// SessionTTL is how long queued messages, and sessions without a connection,
+	// are kept. 0 uses DefaultSessionTTL.
+	SessionTTL time.Duration
+	// TLS is the server certificate and client certificate policy; nil uses a
+	// self-signed development certificate. Client certificates are always requested.
+	TLS *tls.Config
+	// Authenticator, if set, requires every connection to Connect, prove its key and
+	// pass authentication before it may publish or subscribe.
+	Authenticator Authenticator
+	// SendQueue is the number of messages queued per connection before Overflow
+	// applies. 0 uses DefaultSendQueue.
+	SendQueue int
+	// Overflow is what happens to messages for a connection whose queue is full
+	Overflow OverflowPolicy
+	// RateLimits caps how fast clients publish; zero values are unlimited
+	RateLimits RateLimits
+	// Authorizer, if set, decides which topics each connection may publish to and
+	// subscribe to (e.g. an ACL or ACLFile); denials are FORBIDDEN errors.
+	Authorizer Authorizer
+	// TraceExporter receives a span per forwarded publish, with cleartext metadata
+	// only. It joins the publisher's trace if the Publish has a traceparent routing header.
+	TraceExporter trace.Exporter
+	// LogLevel, if set, is the level the admin API reads and changes (see AdminHandler)
+	LogLevel *slog.LevelVar
+	// GoAwayGrace is how long Shutdown leaves each connection open after its GoAway,
+	// for the client to collect its Acks and hang up. 0 uses DefaultGoAwayGrace.
+	GoAwayGrace time.Duration
+}
+
+const (
+	DefaultSessionMaxBytes = 16 << 20
+	DefaultSessionTTL      = 24 * time.Hour
+	DefaultGoAwayGrace     = 5 * time.Second
+)
+
+// subKey identifies a subscription of one connection; group is empty unless shared
+type subKey struct {
+	conn  string
+	group string
+}
+
+// subEntry is one subscription in r.subs
+type subEntry struct {
+	filter string
+	key    subKey
 }
 
 type subInfo struct {
 	schemaID  string
 	publicKey []byte
 	send      func(*proto.Frame) error
+	principal *atomic.Pointer[Principal] // who subscribed, for RecheckSubscriptions
+}
+
+// connState is the relay's view of one client connection
+type connState struct {
+	c        *transport.Conn
+	key      string // remote address
+	identity []byte // public key proven with Connect/Prove; nil until then
+	claimed  []byte // public key from Connect, awaiting Prove
+	nonce    []byte
+	verifier *crypto.KeyPair     // one-time key the Prove is sealed for
+	hello    *proto.ConnectFrame // Connect awaiting Prove
+	nodeID   string
+	will     *proto.PublishFrame // published if the connection drops without a Disconnect
+	presence bool
+	auth     *Identity   // set once the Authenticator accepted the connection
+	expiry   *time.Timer // closes the connection when auth expires
+	rate     *bucket     // per-connection publish limit; nil if unlimited
+	out      *outbox     // queue for Message frames
+	helloAt  time.Time   // when the pending Connect arrived, for handshake latency
+
+	subscriber atomic.Pointer[Principal] // principal of its subscriptions; replaced on Auth
+}
+
+// principal describes the connection to the Authorizer
+func (cs *connState) principal() *Principal {
+	p := &Principal{NodeID: cs.nodeID, Auth: cs.auth}
+	if cs.identity != nil {
+		p.KeyID = cs.identity[:8]
+	}
+	return p
+}
+
+// rateIdentity names the connection for identity rate limits: the authenticated
+// subject, else the proven key; empty if neither
+func (cs *connState) rateIdentity() string {
+	if cs.auth != nil {
+		return cs.auth.Subject
+	}
+	if cs.identity != nil {
+		return hex.EncodeToString(cs.identity)
+	}
+	return ""
+}
+
+// PresenceTopicPrefix is where the relay publishes presence: $presence/<node_id>
+const PresenceTopicPrefix = "$presence/"
+
+// PresenceTopic returns the presence topic of nodeID
+func PresenceTopic(nodeID string) string {
+	return PresenceTopicPrefix + nodeID
 }
 
 // RunRelay starts a relay server on addr
 func RunRelay(ctx context.Context, addr string) (*RelayServer, error) {
-	r := &RelayServer{}
-	server, err := transport.ListenQUICWithHandler(ctx, addr, r.handleConn)
+	return RunRelayWithConfig(ctx, RelayConfig{Addr: addr})
+}
+
+// RunRelayWithConfig starts a relay server with session limits
+func RunRelayWithConfig(ctx context.Context, cfg RelayConfig) (*RelayServer, error) {
+	if cfg.SessionMaxBytes <= 0 {
+		cfg.SessionMaxBytes = DefaultSessionMaxBytes
+	}
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = DefaultSessionTTL
+	}
+	if cfg.SendQueue <= 0 {
+		cfg.SendQueue = DefaultSendQueue
+	}
+	if cfg.GoAwayGrace <= 0 {
+		cfg.GoAwayGrace = DefaultGoAwayGrace
+	}
+	r := &RelayServer{
+		cfg:         cfg,
+		ctx:         ctx,
+		subs:        topic.NewTrie[subKey, *subInfo](),
+		limits:      newRateLimiter(cfg.RateLimits),
+		tracer:      trace.NewTracer(cfg.TraceExporter),
+		next:        make(map[string]int),
+		presence:    make(map[string]int),
+		outboxes:    make(map[string]*outbox),
+		conns:       make(map[string]*ConnectionInfo),
+		retained:    make(map[string]map[string]*proto.MessageFrame),
+		sessions:    make(map[string]*session),
+		sessFilters: topic.NewTrie[string, *session](),
+	}
+	r.metrics = newRelayMetrics(r)
+	tlsCfg := cfg.TLS
+	if tlsCfg != nil && tlsCfg.ClientAuth == tls.NoClientCert {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ClientAuth = tls.RequestClientCert
+	}
+	server, err := transport.ListenQUICWithTLS(ctx, cfg.Addr, tlsCfg, r.handleConn)
 	if err != nil {
 		return nil, err
 	}
 	r.server = server
+	if n, ok := cfg.Authorizer.(interface{ OnReload(func()) }); ok {
+		n.OnReload(r.RecheckSubscriptions)
+	}
+	go r.expireSessions(ctx)
+	go r.limits.sweep(ctx, time.Minute)
 	slog.Info("relay listening", "addr", server.LocalAddr())
 	return r, nil
 }
 
+// Addr returns the address the relay listens on
+func (r *RelayServer) Addr() string {
+	return r.server.LocalAddr()
+}
+
+// goAwayFrame tells a client the relay is shutting down
+var goAwayFrame = &proto.Frame{Type: proto.FrameTypeGoAway, GoAway: &proto.GoAwayFrame{Reason: "relay shutting down"}}
+
+// Shutdown stops the relay gracefully. It refuses new connections and sends every
+// client a GoAway after the messages already queued for it, then waits for the
+// clients to move to another relay and close their connections. A connection still
+// open GoAwayGrace after its GoAway was written is closed, as are all connections
+// still open when ctx is done; ctx.Err() is returned then. Wills and offline
+// presence are not published for connections that close during shutdown.
+func (r *RelayServer) Shutdown(ctx context.Context) error {
+	r.server.StopAccepting()
+	r.mu.Lock()
+	r.closing = true
+	outs := make([]*outbox, 0, len(r.outboxes))
+	for _, o := range r.outboxes {
+		outs = append(outs, o)
+	}
+	r.mu.Unlock()
+	slog.Info("relay: shutting down", "connections", len(outs))
+	for _, o := range outs {
+		o.goAway(r.cfg.GoAwayGrace)
+	}
+
+	var err error
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for r.QueueStats().Connections > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			r.mu.Lock()
+			slog.Warn("relay: shutdown deadline passed, closing connections", "connections", len(r.outboxes))
+			for _, o := range r.outboxes {
+				o.close()
+				o.c.Close()
+			}
+			r.mu.Unlock()
+			// handleConn returns as soon as its connection is closed
+			for r.QueueStats().Connections > 0 {
+				<-t.C
+			}
+		case <-t.C:
+		}
+	}
+	r.server.Close()
+	return err
+}
+
 func (r *RelayServer) handleConn(c *transport.Conn) {
-	key := c.RemoteAddr()
+	cs := &connState{c: c, key: c.RemoteAddr(), rate: r.limits.connBucket()}
+	cs.out = newOutbox(c, cs.key, r.cfg.SendQueue, r.cfg.Overflow, &r.queueStats)
+	r.mu.Lock()
+	if r.closing {
+		r.mu.Unlock()
+		cs.out.goAway(r.cfg.GoAwayGrace)
+		return
+	}
+	r.outboxes[cs.key] = cs.out
+	r.track(cs)
+	r.mu.Unlock()
+	r.metrics.accepted.Inc()
+	r.metrics.connections.Add(1)
 	defer func() {
+		r.mu.Lock()
+		delete(r.outboxes, cs.key)
+		delete(r.conns, cs.key)
+		r.metrics.closedSent.Add(c.BytesSent())
+		r.metrics.closedReceived.Add(c.BytesReceived())
+		closing := r.closing
+		r.mu.Unlock()
+		r.metrics.connections.Add(-1)
+		cs.out.close()
 		// Remove from all topic subscriptions
-		r.subs.Range(func(topic, v interface{}) bool {
-			m := v.(*sync.Map)
-			m.Delete(key)
+		var groups []subEntry
+		r.subs.RemoveWhere(func(filter string, k subKey) bool {
+			if k.conn != cs.key {
+				return false
+			}
+			if k.group != "" {
+				groups = append(groups, subEntry{filter, k})
+			}
 			return true
 		})
+		for _, g := range groups {
+			r.releaseGroup(g.filter, g.key.group)
+		}
+		r.detachSession(cs)
+		// the client did not fail, the relay is going away: no will, no offline presence
+		if cs.will != nil && !closing {
+			slog.Info("relay: publishing will", "topic", cs.will.Topic, "node", cs.nodeID)
+			r.publish(cs.will)
+		}
+		if cs.presence && !closing {
+			r.leave(cs.nodeID)
+		}
+		if cs.expiry != nil {
+			cs.expiry.Stop()
+		}
 		c.Close()
 	}()
 
-	var f proto.Frame
 	for {
+		var f proto.Frame
 		if err := c.RecvFrame(&f); err != nil {
+			if errors.Is(err, proto.ErrMalformedFrame) {
+				r.metrics.decodeErrors.Inc()
+				slog.Info("relay: closing connection after malformed frame", "remote", cs.key, "err", err)
+			}
 			return
 		}
 		switch f.Type {
+		case proto.FrameTypeConnect:
+			if cf := f.Connect; cf != nil {
+				r.handleConnect(cs, cf)
+			}
+		case proto.FrameTypeProve:
+			if pf := f.Prove; pf != nil {
+				r.handleProve(cs, pf)
+			}
+		case proto.FrameTypeAuth:
+			if af := f.Auth; af != nil {
+				r.handleAuth(cs, af)
+			}
+		case proto.FrameTypeDisconnect:
+			cs.will = nil
+			c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
 		case proto.FrameTypeSubscribe:
-			if s := f.Subscribe; s != nil {
-				v, _ := r.subs.LoadOrStore(s.Topic, &sync.Map{})
-				m := v.(*sync.Map)
-				m.Store(key, &subInfo{
-					schemaID:  s.SchemaID,
-					publicKey: s.PublicKey,
-					send:      c.SendFrame,
-				})
-				c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
+			if s := f.Subscribe; s != nil && r.authenticated(cs, true) {
+				r.handleSubscribe(cs, s)
 			}
 		case proto.FrameTypeUnsubscribe:
-			if u := f.Unsubscribe; u != nil {
-				if v, ok := r.subs.Load(u.Topic); ok {
-					v.(*sync.Map).Delete(key)
+			if u := f.Unsubscribe; u != nil && r.authenticated(cs, false) {
+				r.subs.Remove(u.Topic, subKey{conn: cs.key, group: u.Group})
+				if u.Group != "" {
+					r.releaseGroup(u.Topic, u.Group)
+				}
+				if u.Group == "" && cs.identity != nil {
+					r.removeSessionFilter(hex.EncodeToString(cs.identity), u.Topic)
 				}
 			}
 		case proto.FrameTypePublish:
-			if p := f.Publish; p != nil {
-				// Forward to all subscribers of this topic (zero-knowledge: payload stays encrypted)
-				if v, ok := r.subs.Load(p.Topic); ok {
-					msg := &proto.Frame{
-						Type: proto.FrameTypeMessage,
-						Message: &proto.MessageFrame{
-							Topic:            p.Topic,
-							EncryptedPayload: p.Payload,
-							SenderKeyID:      p.RecipientKeyID,
-							SenderPublicKey:  p.SenderPublicKey,
-						},
-					}
-					count := 0
-					v.(*sync.Map).Range(func(k, val interface{}) bool {
-						si := val.(*subInfo)
-						if si.send != nil {
-							if err := si.send(msg); err != nil {
-								slog.Error("relay: failed to forward to subscriber", "err", err, "sub", k)
-							} else {
-								count++
-							}
-						}
-						return true
-					})
-					slog.Info("relay: forwarded", "topic", p.Topic, "subscribers", count)
-				}
-				c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
+			if p := f.Publish; p != nil && r.authenticated(cs, true) {
+				r.handlePublish(cs, p)
 			}
 		}
 	}
 }
+
+// handleConnect challenges the client to prove it holds the private key it claims
+func (r *RelayServer) handleConnect(cs *connState, cf *proto.ConnectFrame) {
+	if cs.identity != nil {
+		sendError(cs.c, "UNSUPPORTED", "connection already proved a key")
+		return
+	}
+	if len(cf.PublicKey) != crypto.PublicKeySize {
+		sendError(cs.c, "UNAUTHORIZED", "invalid public key")
+		return
+	}
+	if cf.Presence && !topic.IsLevel(cf.NodeID) {
+		sendError(cs.c, "TOPIC_INVALID", fmt.Sprintf("node_id %q cannot be used as a presence topic level", cf.NodeID))
+		return
+	}
+	if w := cf.Will; w != nil {
+		if err := validatePublishTopic(w.Topic); err != nil {
+			sendError(cs.c, "TOPIC_INVALID", err.Error())
+			return
+		}
+		if err := proto.ValidateRoutingHeaders(w.Headers); err != nil {
+			sendError(cs.c, "HEADERS_INVALID", err.Error())
+			return
+		}
+		if !bytes.Equal(w.SenderPublicKey, cf.PublicKey) {
+			sendError(cs.c, "UNAUTHORIZED", "will must be sent by the connecting key")
+			return
+		}
+	}
+	verifier, err := crypto.GenerateKeyPair()
+	if err != nil {
+		sendError(cs.c, "INTERNAL", err.Error())
+		return
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		sendError(cs.c, "INTERNAL", err.Error())
+		return
+	}
+	cs.claimed, cs.nonce, cs.verifier, cs.hello = cf.PublicKey, nonce, verifier, cf
+	cs.helloAt = time.Now()
+	cs.c.SendFrame(&proto.Frame{Type: proto.FrameTypeChallenge, Challenge: &proto.ChallengeFrame{
+		Nonce: nonce, PublicKey: verifier.Public[:],
+	}})
+}
+
+func (r *RelayServer) handleProve(cs *connState, pf *proto.ProveFrame) {
+	if cs.verifier == nil {
+		sendError(cs.c, "UNAUTHORIZED", "no pending challenge")
+		return
+	}
+	var prover [crypto.PublicKeySize]byte
+	copy(prover[:], cs.claimed)
+	ok := crypto.VerifyProof(pf.Proof, cs.nonce, &prover, cs.verifier.Private)
+	claimed, hello := cs.claimed, cs.hello
+	cs.claimed, cs.nonce, cs.verifier, cs.hello = nil, nil, nil, nil
+	if !ok {
+		r.metrics.authFailures.Inc()
+		sendError(cs.c, "UNAUTHORIZED", "key possession proof failed")
+		return
+	}
+	if r.cfg.Authenticator != nil {
+		id, err := r.authenticate(cs, hello.NodeID, claimed, hello.Token)
+		if err != nil {
+			sendError(cs.c, "UNAUTHORIZED", err.Error())
+			return
+		}
+		cs.auth = id
+	}
+	cs.identity, cs.nodeID = claimed, hello.NodeID
+	if w := hello.Will; w != nil && !r.allowed(cs, ActionPublish, w.Topic, w.SchemaID) {
+		cs.identity, cs.auth = nil, nil
+		return
+	}
+	if hello.Presence && !r.mayAnnounce(cs, hello.NodeID) {
+		cs.identity, cs.auth = nil, nil
+		return
+	}
+	r.expireAt(cs)
+	r.identify(cs)
+	r.metrics.handshake.Observe(time.Since(cs.helloAt).Seconds())
+	cs.will = hello.Will
+	cs.c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
+	if hello.Presence {
+		cs.presence = true
+		r.join(cs.nodeID)
+	}
+}
+
+// authenticate runs the Authenticator for a connection that proved key
+func (r *RelayServer) authenticate(cs *connState, nodeID string, key []byte, token string) (*Identity, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, 10*time.Second)
+	defer cancel()
+	id, err := r.cfg.Authenticator.Authenticate(ctx, &AuthRequest{
+		NodeID:           nodeID,
+		PublicKey:        key,
+		Token:            token,
+		PeerCertificates: cs.c.PeerCertificates(),
+	})
+	if err != nil {
+		r.metrics.authFailures.Inc()
+		slog.Info("relay: authentication failed", "node", nodeID, "remote", cs.key, "err", err)
+		return nil, err
+	}
+	slog.Debug("relay: authenticated", "node", nodeID, "subject", id.Subject, "method", id.Method)
+	return id, nil
+}
+
+// handleAuth replaces the credentials of an authenticated connection, e.g. with a
+// refreshed token. The subject must not change; on failure the old ones stay.
+func (r *RelayServer) handleAuth(cs *connState, af *proto.AuthFrame) {
+	if r.cfg.Authenticator == nil || cs.auth == nil {
+		sendError(cs.c, "UNSUPPORTED", "Auth requires an authenticated connection")
+		return
+	}
+	id, err := r.authenticate(cs, cs.nodeID, cs.identity, af.Token)
+	if err != nil {
+		sendError(cs.c, "UNAUTHORIZED", err.Error())
+		return
+	}
+	if id.Subject != cs.auth.Subject {
+		sendError(cs.c, "UNAUTHORIZED", fmt.Sprintf("credentials are for %q, not %q", id.Subject, cs.auth.Subject))
+		return
+	}
+	cs.auth = id
+	cs.subscriber.Store(cs.principal())
+	r.expireAt(cs)
+	cs.c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
+}
+
+// expireAt (re)arms the timer that closes the connection when its credentials expire
+func (r *RelayServer) expireAt(cs *connState) {
+	if cs.expiry != nil {
+		cs.expiry.Stop()
+		cs.expiry = nil
+	}
+	if cs.auth == nil || cs.auth.Expires.IsZero() {
+		return
+	}
+	c, nodeID := cs.c, cs.nodeID
+	cs.expiry = time.AfterFunc(time.Until(cs.auth.Expires), func() {
+		slog.Info("relay: credentials expired, closing connection", "node", nodeID, "remote", cs.key)
+		c.Close()
+	})
+}
+
+// authenticated reports whether the connection may use the relay; if not and reply
+// is set, the client is told with an UNAUTHORIZED error
+func (r *RelayServer) authenticated(cs *connState, reply bool) bool {
+	if r.cfg.Authenticator == nil {
+		return true
+	}
+	msg := "authentication required: send Connect with credentials"
+	if cs.auth != nil {
+		if cs.auth.Expires.IsZero() || time.Now().Before(cs.auth.Expires) {
+			return true
+		}
+		msg = "credentials expired"
+	}
+	if reply {
+		sendError(cs.c, "UNAUTHORIZED", msg)
+	}
+	return false
+}
+
+// allowed reports whether the connection's grants and the Authorizer let it act on
+// name with schemaID; if not, the client is told with a FORBIDDEN error
+func (r *RelayServer) allowed(cs *connState, action Action, name, schemaID string) bool {
+	ok := cs.auth == nil || cs.auth.Grants == nil || cs.auth.Grants.Allow(action, name, schemaID)
+	if a := r.cfg.Authorizer; ok && a != nil {
+		ok = a.Allow(cs.principal(), action, name)
+	}
+	if ok {
+		return true
+	}
+	slog.Info("relay: forbidden", "action", action, "topic", name, "schema", schemaID, "node", cs.nodeID, "remote", cs.key)
+	r.metrics.forbidden.Inc()
+	sendError(cs.c, "FORBIDDEN", fmt.Sprintf("not allowed to %s %q with schema %q", action, name, schemaID))
+	return false
+}
+
+// RecheckSubscriptions checks every subscription, persistent ones included, against
+// the Authorizer again and removes those it now denies, so revoked access ends without
+// waiting for the client to reconnect. The client is not told; a reconnect renews its
+// subscriptions and gets FORBIDDEN. It runs after every ACLFile reload; call it after
+// changing the rules of another Authorizer.
+func (r *RelayServer) RecheckSubscriptions() {
+	a := r.cfg.Authorizer
+	if a == nil {
+		return
+	}
+	var subs []subEntry
+	r.subs.Each(func(filter string, k subKey, si *subInfo) {
+		if p := si.principal.Load(); p != nil && !a.Allow(p, ActionSubscribe, filter) {
+			subs = append(subs, subEntry{filter, k})
+		}
+	})
+	for _, s := range subs {
+		r.subs.Remove(s.filter, s.key)
+		if s.key.group != "" {
+			r.releaseGroup(s.filter, s.key.group)
+		}
+		slog.Info("relay: subscription revoked", "topic", s.filter, "group", s.key.group, "remote", s.key.conn)
+	}
+
+	var sessions []struct{ key, filter string }
+	r.sessMu.Lock()
+	for key, sess := range r.sessions {
+		sess.mu.Lock()
+		var p *Principal
+		if sess.principal != nil {
+			p = sess.principal.Load()
+		}
+		for filter := range sess.filters {
+			if p != nil && !a.Allow(p, ActionSubscribe, filter) {
+				sessions = append(sessions, struct{ key, filter string }{key, filter})
+			}
+		}
+		sess.mu.Unlock()
+	}
+	r.sessMu.Unlock()
+	for _, s := range sessions {
+		r.removeSessionFilter(s.key, s.filter)
+		slog.Info("relay: persistent subscription revoked", "topic", s.filter, "session", s.key)
+	}
+}
+
+// mayAnnounce reports whether a proven connection may announce presence as nodeID,
+// which is only claimed in its Connect: nodeID must be its key ID (hex) or its
+// authenticated subject, or the grants and Authorizer must allow publishing to the
+// presence topic. Otherwise any client could mark another node online or hide it going
+// offline. If not, the client is told with a FORBIDDEN error.
+func (r *RelayServer) mayAnnounce(cs *connState, nodeID string) bool {
+	if nodeID == hex.EncodeToString(cs.identity[:8]) || cs.auth != nil && cs.auth.Subject != "" && nodeID == cs.auth.Subject {
+		return true
+	}
+	if r.cfg.Authorizer != nil || cs.auth != nil && cs.auth.Grants != nil {
+		return r.allowed(cs, ActionPublish, PresenceTopic(nodeID), proto.SchemaPresence)
+	}
+	slog.Info("relay: forbidden presence", "node", nodeID, "remote", cs.key)
+	r.metrics.forbidden.Inc()
+	sendError(cs.c, "FORBIDDEN", fmt.Sprintf("presence for node_id %q needs node_id to be the key ID or subject, or an ACL grant", nodeID))
+	return false
+}
+
+// join counts a connection announcing nodeID and publishes it online on the first one
+func (r *RelayServer) join(nodeID string) {
+	r.mu.Lock()
+	r.presence[nodeID]++
+	first := r.presence[nodeID] == 1
+	r.mu.Unlock()
+	if first {
+		r.publishPresence(nodeID, true)
+	}
+}
+
+// leave publishes nodeID offline when its last announcing connection closes
+func (r *RelayServer) leave(nodeID string) {
+	r.mu.Lock()
+	r.presence[nodeID]--
+	last := r.presence[nodeID] == 0
+	if last {
+		delete(r.presence, nodeID)
+	}
+	r.mu.Unlock()
+	if last {
+		r.publishPresence(nodeID, false)
+	}
+}
+
+// publishPresence sends and retains the presence of nodeID. Presence is metadata the
+// relay already has, so unlike other messages it is not encrypted.
+func (r *RelayServer) publishPresence(nodeID string, online bool) {
+	payload, err := json.Marshal(proto.Presence{NodeID: nodeID, Online: online, TimestampMs: time.Now().UnixMilli()})
+	if err != nil {
+		return
+	}
+	name := PresenceTopic(nodeID)
+	msg := &proto.Frame{Type: proto.FrameTypeMessage, Message: &proto.MessageFrame{
+		Topic:            name,
+		EncryptedPayload: payload,
+		SchemaID:         proto.SchemaPresence,
+		System:           true,
+	}}
+	r.retain(name, nil, msg.Message)
+	r.forward(name, msg)
+	slog.Info("relay: presence", "node", nodeID, "online", online)
+}
+
+// validatePublishTopic checks a topic clients may publish to (no wildcards, not relay-owned)
+func validatePublishTopic(name string) error {
+	if err := topic.ValidateName(name); err != nil {
+		return err
+	}
+	if strings.HasPrefix(name, PresenceTopicPrefix) {
+		return fmt.Errorf("topic %q is reserved for the relay", name)
+	}
+	return nil
+}
+
+func (r *RelayServer) handleSubscribe(cs *connState, s *proto.SubscribeFrame) {
+	c := cs.c
+	if err := topic.ValidateFilter(s.Topic); err != nil {
+		sendError(c, "TOPIC_INVALID", err.Error())
+		return
+	}
+	if s.Group != "" {
+		if err := topic.ValidateGroup(s.Group); err != nil {
+			sendError(c, "TOPIC_INVALID", err.Error())
+			return
+		}
+	}
+	if strings.HasPrefix(s.Topic, InboxTopicPrefix) && !ownsInbox(s.Topic, cs.identity) {
+		slog.Info("relay: forbidden", "action", ActionSubscribe, "topic", s.Topic, "node", cs.nodeID, "remote", cs.key)
+		r.metrics.forbidden.Inc()
+		sendError(c, "FORBIDDEN", fmt.Sprintf("%q is not the inbox of the connection's proven key", s.Topic))
+		return
+	}
+	if !r.allowed(cs, ActionSubscribe, s.Topic, s.SchemaID) {
+		return
+	}
+	cs.subscriber.Store(cs.principal())
+	if s.Persistent {
+		if s.Group != "" {
+			sendError(c, "UNSUPPORTED", "shared subscriptions cannot be persistent")
+			return
+		}
+		if cs.identity == nil || !bytes.Equal(cs.identity, s.PublicKey) {
+			sendError(c, "UNAUTHORIZED", "persistent subscriptions require a Connect proving the subscriber's key")
+			return
+		}
+		// The session delivers its backlog and then live messages, in order
+		if isNew := r.attachSession(cs, s); isNew {
+			r.sendRetained(cs, s)
+		}
+		return
+	}
+	r.subs.Add(s.Topic, subKey{conn: cs.key, group: s.Group}, &subInfo{
+		schemaID:  s.SchemaID,
+		publicKey: s.PublicKey,
+		send:      cs.out.send,
+		principal: &cs.subscriber,
+	})
+	c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
+	if s.Group == "" {
+		r.sendRetained(cs, s)
+	}
+}
+
+func (r *RelayServer) sendRetained(cs *connState, s *proto.SubscribeFrame) {
+	for _, m := range r.retainedFor(s.Topic, s.PublicKey) {
+		if cs.out.push(&proto.Frame{Type: proto.FrameTypeMessage, Message: m}) != nil {
+			return
+		}
+	}
+}
+
+func (r *RelayServer) handlePublish(cs *connState, p *proto.PublishFrame) {
+	c := cs.c
+	if err := validatePublishTopic(p.Topic); err != nil {
+		sendError(c, "TOPIC_INVALID", err.Error())
+		return
+	}
+	if err := proto.ValidateRoutingHeaders(p.Headers); err != nil {
+		sendError(c, "HEADERS_INVALID", err.Error())
+		return
+	}
+	if !r.allowed(cs, ActionPublish, p.Topic, p.SchemaID) {
+		return
+	}
+	if wait := r.limits.allow(cs.rate, cs.rateIdentity(), p.Topic, len(p.Payload)); wait > 0 {
+		r.metrics.rateLimited.Inc()
+		slog.Debug("relay: rate limited", "topic", p.Topic, "node", cs.nodeID, "remote", cs.key, "retry_after", wait)
+		c.SendFrame(&proto.Frame{Type: proto.FrameTypeError, Error: &proto.ErrorFrame{
+			Code:         "RATE_LIMITED",
+			Message:      fmt.Sprintf("publish rate exceeded on %q", p.Topic),
+			RetryAfterMs: wait.Milliseconds() + 1,
+		}})
+		return
+	}
+	ctx := context.Background()
+	if sc, err := trace.ParseTraceparent(p.Headers[proto.HeaderTraceparent]); err == nil {
+		ctx = trace.ContextWithSpanContext(ctx, sc)
+	}
+	_, span := r.tracer.Start(ctx, "forward "+p.Topic, trace.KindInternal)
+	reached := r.publish(p)
+	span.SetAttribute("messaging.system", "qumbed")
+	span.SetAttribute("messaging.destination.name", p.Topic)
+	span.SetAttribute("messaging.message.body.size", len(p.Payload))
+	span.SetAttribute("qumbed.subscribers", reached)
+	span.SetAttribute("qumbed.retain", p.Retain)
+	span.End()
+	r.metrics.publishes.Inc()
+	c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
+}
+
+// publish retains and forwards p (a client Publish or a will) and returns the number
+// of connections reached
+func (r *RelayServer) publish(p *proto.PublishFrame) int {
+	if p.Retain && len(p.Payload) == 0 {
+		r.clearRetained(p.Topic, p.RecipientKeyID)
+		return 0
+	}
+	// Forward to all subscribers of this topic (zero-knowledge: payload stays encrypted)
+	msg := &proto.Frame{
+		Type: proto.FrameTypeMessage,
+		Message: &proto.MessageFrame{
+			Topic:            p.Topic,
+			EncryptedPayload: p.Payload,
+			SenderKeyID:      p.RecipientKeyID,
+			SenderPublicKey:  p.SenderPublicKey,
+			SchemaID:         p.SchemaID,
+			Encoding:         p.Encoding,
+			ReplyTo:          p.ReplyTo,
+			CorrelationID:    p.CorrelationID,
+			Envelope:         p.Envelope,
+			Headers:          p.Headers,
+		},
+	}
+	if p.Retain {
+		r.retain(p.Topic, p.RecipientKeyID, msg.Message)
+	}
+	count := r.forward(p.Topic, msg)
+	if count > 0 {
+		slog.Info("relay: forwarded", "topic", p.Topic, "subscribers", count)
+	}
+	return count
+}
+
+type groupMember struct {
+	conn string
+	si   *subInfo
+}
+
+// forward sends msg to every direct subscriber of name, to one member of each
+// shared group (round-robin, skipping members that fail) and to matching persistent
+// sessions, queueing it for offline ones. A connection is sent a message at most
+// once. It returns the number of connections reached.
+func (r *RelayServer) forward(name string, msg *proto.Frame) int {
+	direct := make(map[string]*subInfo)
+	groups := make(map[string][]groupMember) // group + filter -> members
+	r.subs.Match(name, func(filter string, k subKey, si *subInfo) {
+		if k.group == "" {
+			if _, ok := direct[k.conn]; !ok {
+				direct[k.conn] = si
+			}
+			return
+		}
+		g := k.group + "\x00" + filter
+		groups[g] = append(groups[g], groupMember{conn: k.conn, si: si})
+	})
+
+	sent := make(map[string]bool)
+	send := func(conn string, si *subInfo) bool {
+		if sent[conn] {
+			return true
+		}
+		if si.send == nil {
+			return false
+		}
+		if err := si.send(msg); err != nil {
+			r.metrics.forwardErrors.Inc()
+			switch err {
+			case errQueueFull:
+			case errOutboxClosed:
+				slog.Debug("relay: subscriber connection closing", "sub", conn)
+			default:
+				slog.Error("relay: failed to forward to subscriber", "err", err, "sub", conn)
+			}
+			return false
+		}
+		sent[conn] = true
+		return true
+	}
+	for conn, si := range direct {
+		send(conn, si)
+	}
+	for g, members := range groups {
+		sort.Slice(members, func(i, j int) bool { return members[i].conn < members[j].conn })
+		start := r.nextMember(g, len(members))
+		for i := range members {
+			m := members[(start+i)%len(members)]
+			if send(m.conn, m.si) {
+				break
+			}
+		}
+	}
+	queued := 0
+	for _, s := range r.matchSessions(name) {
+		if s.deliver(msg, sent, r.cfg.SessionMaxBytes, r.cfg.SessionTTL) {
+			queued++
+		}
+	}
+	if queued > 0 {
+		r.metrics.sessionQueued.Add(uint64(queued))
+		slog.Debug("relay: queued for offline sessions", "topic", name, "sessions", queued)
+	}
+	r.metrics.forwards.Add(uint64(len(sent)))
+	return len(sent)
+}
+
+// releaseGroup forgets the round-robin position of a shared group once its last
+// member under filter is gone
+func (r *RelayServer) releaseGroup(filter, group string) {
+	for _, k := range r.subs.Keys(filter) {
+		if k.group == group {
+			return
+		}
+	}
+	r.mu.Lock()
+	delete(r.next, group+"\x00"+filter)
+	r.mu.Unlock()
+}
+
+// nextMember advances the round-robin position of shared group g with n members
+func (r *RelayServer) nextMember(g string, n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.next[g] % n
+	r.next[g] = i + 1
+	return i
+}
+
+// retain stores m as the last retained message of name for recipient keyID
+func (r *RelayServer) retain(name string, keyID []byte, m *proto.MessageFrame) {
+	rm := *m
+	rm.Retained = true
+	r.retainMu.Lock()
+	defer r.retainMu.Unlock()
+	byKey, ok := r.retained[name]
+	if !ok {
+		byKey = make(map[string]*proto.MessageFrame)
+		r.retained[name] = byKey
+	}
+	byKey[hex.EncodeToString(keyID)] = &rm
+}
+
+// clearRetained removes the retained message of name for keyID, or for every recipient if keyID is empty
+func (r *RelayServer) clearRetained(name string, keyID []byte) {
+	r.retainMu.Lock()
+	defer r.retainMu.Unlock()
+	if len(keyID) == 0 {
+		delete(r.retained, name)
+		return
+	}
+	if byKey, ok := r.retained[name]; ok {
+		delete(byKey, hex.EncodeToString(keyID))
+		if len(byKey) == 0 {
+			delete(r.retained, name)
+		}
+	}
+}
+
+// retainedFor returns the retained messages matching filter that a subscriber with
+// public key pub can read: those addressed to its key ID and unaddressed ones
+func (r *RelayServer) retainedFor(filter string, pub []byte) []*proto.MessageFrame {
+	want := []string{""}
+	if len(pub) == crypto.PublicKeySize {
+		var k [crypto.PublicKeySize]byte
+		copy(k[:], pub)
+		want = append(want, hex.EncodeToString(crypto.KeyID(&k)))
+	}
+	r.retainMu.RLock()
+	defer r.retainMu.RUnlock()
+	var names []string
+	for name := range r.retained {
+		if topic.Match(filter, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var out []*proto.MessageFrame
+	for _, name := range names {
+		for _, k := range want {
+			if m, ok := r.retained[name][k]; ok {
+				out = append(out, m)
+			}
+		}
+	}
+	return out
+}
+
+func sendError(c *transport.Conn, code, msg string) {
+	c.SendFrame(&proto.Frame{Type: proto.FrameTypeError, Error: &proto.ErrorFrame{Code: code, Message: msg}})
+}
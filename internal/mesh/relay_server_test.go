@@ -0,0 +1,130 @@
+package mesh
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
+	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+	"github.com/SWAI-Ltd/Qumbed/internal/transport"
+)
+
+// startRelay runs a relay with cfg on a free local port until the test ends
+func startRelay(t *testing.T, cfg RelayConfig) *RelayServer {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg.Addr = "127.0.0.1:0"
+	r, err := RunRelayWithConfig(ctx, cfg)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+		r.Shutdown(sctx)
+		scancel()
+		cancel()
+	})
+	return r
+}
+
+// announce connects a node with presence as nodeID and reports the relay's answer
+func announce(t *testing.T, relay, nodeID string, keys *crypto.KeyPair) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	n, err := NewNode(ctx, Config{Addr: "127.0.0.1:0", RelayAddr: relay, DisableDiscovery: true, NodeID: nodeID, Presence: true, Keys: keys})
+	if err == nil {
+		n.Close()
+	}
+	return err
+}
+
+func generateKeys(t *testing.T) *crypto.KeyPair {
+	t.Helper()
+	k, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func isForbidden(err error) bool {
+	var re *RelayError
+	return errors.As(err, &re) && re.Code == "FORBIDDEN"
+}
+
+// TestPresenceSpoofing checks that a node ID claimed in Connect only gets presence
+// when it is bound to the connection: its key ID, or an ACL grant for its key
+func TestPresenceSpoofing(t *testing.T) {
+	owner, other := generateKeys(t), generateKeys(t)
+	ownerID := hex.EncodeToString(crypto.KeyID(owner.Public))
+
+	open := startRelay(t, RelayConfig{}).Addr()
+	if err := announce(t, open, "sensor-1", other); !isForbidden(err) {
+		t.Errorf("open relay, arbitrary node ID: got %v, want FORBIDDEN", err)
+	}
+	if err := announce(t, open, ownerID, other); !isForbidden(err) {
+		t.Errorf("open relay, another key's ID: got %v, want FORBIDDEN", err)
+	}
+	if err := announce(t, open, ownerID, owner); err != nil {
+		t.Errorf("open relay, own key ID: %v", err)
+	}
+
+	acl, err := ParseACL(strings.NewReader("keyid:" + ownerID + " publish $presence/sensor-1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guarded := startRelay(t, RelayConfig{Authorizer: acl}).Addr()
+	if err := announce(t, guarded, "sensor-1", other); !isForbidden(err) {
+		t.Errorf("ACL relay, spoofed node ID: got %v, want FORBIDDEN", err)
+	}
+	if err := announce(t, guarded, "sensor-1", owner); err != nil {
+		t.Errorf("ACL relay, granted node ID: %v", err)
+	}
+}
+
+// TestShutdownGoAwayGrace checks that Shutdown sends a GoAway and closes a
+// connection whose client ignores it once GoAwayGrace has passed
+func TestShutdownGoAwayGrace(t *testing.T) {
+	relay := startRelay(t, RelayConfig{GoAwayGrace: 100 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := transport.DialQUIC(ctx, relay.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	keys := generateKeys(t)
+	sub := &proto.Frame{Type: proto.FrameTypeSubscribe, Subscribe: &proto.SubscribeFrame{Topic: "sensors/#", PublicKey: keys.Public[:]}}
+	if err := c.SendFrame(sub); err != nil {
+		t.Fatal(err)
+	}
+	var f proto.Frame
+	if err := c.RecvFrame(&f); err != nil || f.Type != proto.FrameTypeAck {
+		t.Fatalf("subscribe: got frame type %d, err %v; want Ack", f.Type, err)
+	}
+
+	// read as a client does, without acting on the GoAway
+	frames := make(chan int, 1)
+	go func() {
+		defer close(frames)
+		var f proto.Frame
+		for c.RecvFrame(&f) == nil {
+			frames <- f.Type
+		}
+	}()
+	if err := relay.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if typ, ok := <-frames; !ok || typ != proto.FrameTypeGoAway {
+		t.Fatalf("got frame type %d (open %v), want GoAway", typ, ok)
+	}
+	if typ, ok := <-frames; ok {
+		t.Fatalf("got frame type %d after GoAway, want the connection closed", typ)
+	}
+}
@@ -0,0 +1,253 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
+	"github.com/SWAI-Ltd/Qumbed/internal/proto"
+)
+
+// session holds the persistent subscriptions of one public key. While the subscriber
+// is connected its messages are sent directly; while it is offline their ciphertext is
+// queued and delivered in order when it reconnects and proves the key again.
+type session struct {
+	key   string // public key (hex)
+	keyID []byte // crypto.KeyID of the key; messages sealed for other keys are not queued
+
+	mu           sync.Mutex
+	principal    *atomic.Pointer[Principal] // of the connection that last attached, for RecheckSubscriptions
+	filters      map[string]bool
+	conn         string                   // connection key while online, "" while offline
+	send         func(*proto.Frame) error // nil while offline or delivering the backlog
+	queue        []queuedMessage
+	bytes        int
+	offlineSince time.Time
+}
+
+type queuedMessage struct {
+	f       *proto.Frame
+	size    int
+	expires time.Time
+}
+
+// attachSession adds a persistent subscription for the connection's proven key,
+// acknowledges it and, if the session was offline, delivers its backlog before any
+// live message. It reports whether the filter is new to the session.
+func (r *RelayServer) attachSession(cs *connState, s *proto.SubscribeFrame) bool {
+	key := hex.EncodeToString(cs.identity)
+	r.sessMu.Lock()
+	sess, ok := r.sessions[key]
+	if !ok {
+		var pub [crypto.PublicKeySize]byte
+		copy(pub[:], cs.identity)
+		sess = &session{key: key, keyID: crypto.KeyID(&pub), filters: make(map[string]bool)}
+		r.sessions[key] = sess
+	}
+	sess.mu.Lock()
+	r.sessMu.Unlock()
+	isNew := !sess.filters[s.Topic]
+	sess.filters[s.Topic] = true
+	sess.principal = &cs.subscriber
+	r.sessFilters.Add(s.Topic, key, sess)
+	attach := sess.conn != cs.key
+	if attach {
+		// live messages are queued behind the backlog until drainSession catches up
+		sess.conn, sess.send = cs.key, nil
+	}
+	sess.mu.Unlock()
+
+	cs.c.SendFrame(&proto.Frame{Type: proto.FrameTypeAck, Ack: &proto.AckFrame{OK: true}})
+	if attach {
+		r.drainSession(sess, cs)
+	}
+	return isNew
+}
+
+// drainSession delivers the session's backlog to cs and then has live messages sent
+// to it directly. sess.mu is not held while waiting for room in the send queue, so a
+// slow subscriber does not stall publishers; what they publish meanwhile is queued
+// behind the backlog and delivered in a later round.
+func (r *RelayServer) drainSession(sess *session, cs *connState) {
+	delivered := 0
+	defer func() {
+		if delivered > 0 {
+			slog.Info("relay: delivered session backlog", "session", sess.key, "messages", delivered)
+		}
+	}()
+	for {
+		sess.mu.Lock()
+		if sess.conn != cs.key {
+			sess.mu.Unlock()
+			return // detached meanwhile; the rest waits for the next connection
+		}
+		backlog := sess.queue
+		if len(backlog) == 0 {
+			sess.send = cs.out.send
+			sess.mu.Unlock()
+			return
+		}
+		sess.queue, sess.bytes = nil, 0
+		sess.mu.Unlock()
+
+		now := time.Now()
+		for i, q := range backlog {
+			if now.After(q.expires) {
+				continue
+			}
+			if err := cs.out.push(q.f); err != nil {
+				slog.Error("relay: failed to deliver session backlog", "err", err, "session", sess.key)
+				sess.requeue(backlog[i:])
+				return
+			}
+			delivered++
+		}
+	}
+}
+
+// requeue puts undelivered backlog back in front of the queue
+func (s *session) requeue(backlog []queuedMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(backlog[:len(backlog):len(backlog)], s.queue...)
+	s.bytes = 0
+	for _, q := range s.queue {
+		s.bytes += q.size
+	}
+}
+
+// detachSession marks the connection's session offline; messages are queued from now on
+func (r *RelayServer) detachSession(cs *connState) {
+	if cs.identity == nil {
+		return
+	}
+	r.sessMu.Lock()
+	sess, ok := r.sessions[hex.EncodeToString(cs.identity)]
+	r.sessMu.Unlock()
+	if !ok {
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.conn == cs.key {
+		sess.conn, sess.send = "", nil
+		sess.offlineSince = time.Now()
+	}
+}
+
+// removeSessionFilter drops a persistent subscription; a session without any is deleted
+func (r *RelayServer) removeSessionFilter(key, filter string) {
+	r.sessMu.Lock()
+	defer r.sessMu.Unlock()
+	sess, ok := r.sessions[key]
+	if !ok {
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	delete(sess.filters, filter)
+	r.sessFilters.Remove(filter, key)
+	if len(sess.filters) == 0 {
+		delete(r.sessions, key)
+	}
+}
+
+// matchSessions returns the sessions with a filter matching name, once each
+func (r *RelayServer) matchSessions(name string) []*session {
+	var out []*session
+	seen := make(map[string]bool)
+	r.sessFilters.Match(name, func(_ string, key string, s *session) {
+		if !seen[key] {
+			seen[key] = true
+			out = append(out, s)
+		}
+	})
+	return out
+}
+
+// deliver sends msg to the session's connection, or queues it while offline or while
+// the backlog is being delivered. sent records connections that already got msg. It
+// reports whether msg was queued.
+func (s *session) deliver(msg *proto.Frame, sent map[string]bool, maxBytes int, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != "" && sent[s.conn] {
+		return false
+	}
+	if s.send != nil {
+		if err := s.send(msg); err != nil {
+			switch err {
+			case errQueueFull:
+			case errOutboxClosed:
+				slog.Debug("relay: session connection closing", "session", s.key)
+			default:
+				slog.Error("relay: failed to forward to session", "err", err, "session", s.key)
+			}
+		} else {
+			sent[s.conn] = true
+		}
+		return false
+	}
+	if keyID := msg.Message.SenderKeyID; len(keyID) > 0 && !bytes.Equal(keyID, s.keyID) {
+		return false // sealed for someone else; the subscriber could not open it
+	}
+	size := len(msg.Message.EncryptedPayload)
+	if size > maxBytes {
+		return false
+	}
+	now := time.Now()
+	s.expire(now)
+	for s.bytes+size > maxBytes {
+		s.bytes -= s.queue[0].size
+		s.queue = s.queue[1:]
+		slog.Debug("relay: session queue full, dropped oldest", "session", s.key)
+	}
+	s.queue = append(s.queue, queuedMessage{f: msg, size: size, expires: now.Add(ttl)})
+	s.bytes += size
+	return true
+}
+
+// expire drops queued messages past their TTL (the queue is in expiry order)
+func (s *session) expire(now time.Time) {
+	i := 0
+	for i < len(s.queue) && now.After(s.queue[i].expires) {
+		s.bytes -= s.queue[i].size
+		i++
+	}
+	s.queue = s.queue[i:]
+}
+
+// expireSessions periodically removes expired messages and sessions that have been
+// offline longer than the session TTL
+func (r *RelayServer) expireSessions(ctx context.Context) {
+	interval := r.cfg.SessionTTL / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			r.sessMu.Lock()
+			for key, sess := range r.sessions {
+				sess.mu.Lock()
+				sess.expire(now)
+				if sess.conn == "" && now.Sub(sess.offlineSince) > r.cfg.SessionTTL {
+					delete(r.sessions, key)
+					r.sessFilters.RemoveKey(key)
+					slog.Info("relay: session expired", "session", key, "dropped", len(sess.queue))
+				}
+				sess.mu.Unlock()
+			}
+			r.sessMu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package mesh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/SWAI-Ltd/Qumbed/internal/crypto"
+	"github.com/SWAI-Ltd/Qumbed/internal/topic"
+)
+
+// InboxTopicPrefix is the prefix of the per-node topics replies are sent to:
+// $inbox/<key id hex>/<random>. The relay lets only the owner of the key subscribe.
+const InboxTopicPrefix = "$inbox/"
+
+// pendingRequest is a Request waiting for its reply
+type pendingRequest struct {
+	ch   chan Message
+	peer *[crypto.PublicKeySize]byte // the request was sealed for this key; only it may answer
+}
+
+var (
+	// ErrNoReplyTo is returned by Reply for a message that is not a request
+	ErrNoReplyTo = errors.New("message has no reply-to topic")
+	// ErrNoRelay is returned by Request when the node has no relay to receive the reply on
+	ErrNoRelay = errors.New("request/reply needs a relay")
+)
+
+// Request publishes payload to recipientPub on topic name and waits for the reply,
+// sealed for this node. ctx bounds the wait; a reply arriving after it is dropped.
+func (n *Node) Request(ctx context.Context, name, schemaID string, payload []byte, recipientPub *[crypto.PublicKeySize]byte, opts PublishOptions) (Message, error) {
+	if n.relay == nil {
+		return Message{}, ErrNoRelay
+	}
+	inbox, err := n.subscribeInbox(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	id, err := randomID()
+	if err != nil {
+		return Message{}, err
+	}
+	ch := make(chan Message, 1)
+	n.reqMu.Lock()
+	n.pending[id] = &pendingRequest{ch: ch, peer: recipientPub}
+	n.reqMu.Unlock()
+	defer func() {
+		n.reqMu.Lock()
+		delete(n.pending, id)
+		n.reqMu.Unlock()
+	}()
+
+	opts.ReplyTo, opts.CorrelationID = inbox, id
+	if err := n.PublishWithOptions(ctx, name, schemaID, payload, recipientPub, opts); err != nil {
+		return Message{}, err
+	}
+	select {
+	case m := <-ch:
+		return m, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// Reply answers request req with payload, sealed for the requester's key
+func (n *Node) Reply(ctx context.Context, req Message, schemaID string, payload []byte, opts PublishOptions) error {
+	if req.ReplyTo == "" || req.Sender == nil {
+		return ErrNoReplyTo
+	}
+	opts.ReplyTo, opts.CorrelationID = "", req.CorrelationID
+	return n.PublishWithOptions(ctx, req.ReplyTo, schemaID, payload, req.Sender, opts)
+}
+
+// subscribeInbox subscribes to this node's reply topic once and returns it
+func (n *Node) subscribeInbox(ctx context.Context) (string, error) {
+	// not under reqMu: replies are matched on the receive path while this waits for the Ack
+	n.inboxMu.Lock()
+	defer n.inboxMu.Unlock()
+	n.reqMu.Lock()
+	inbox := n.inbox
+	n.reqMu.Unlock()
+	if inbox != "" {
+		return inbox, nil
+	}
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	inbox = InboxTopicPrefix + hex.EncodeToString(crypto.KeyID(n.keys.Public)) + "/" + id
+	if err := n.Subscribe(ctx, inbox, ""); err != nil {
+		return "", err
+	}
+	n.reqMu.Lock()
+	n.inbox = inbox
+	n.reqMu.Unlock()
+	return inbox, nil
+}
+
+// handleReply hands a message on the inbox to its waiting Request; it reports whether
+// m was a reply (late replies, and replies not sealed by the key the request was sent
+// to, are dropped rather than delivered to OnMessage)
+func (n *Node) handleReply(m Message) bool {
+	if m.CorrelationID == "" {
+		return false
+	}
+	n.reqMu.Lock()
+	defer n.reqMu.Unlock()
+	if n.inbox == "" || m.Topic != n.inbox {
+		return false
+	}
+	req, ok := n.pending[m.CorrelationID]
+	if !ok {
+		return true
+	}
+	if m.Sender == nil || *m.Sender != *req.peer {
+		slog.Warn("dropping reply from a key the request was not sent to", "topic", m.Topic, "correlation_id", m.CorrelationID)
+		return true
+	}
+	select {
+	case req.ch <- m:
+	default: // already answered
+	}
+	return true
+}
+
+// ownsInbox reports whether filter, an $inbox/ filter, is the inbox of key: its
+// second level must be the key ID, so wildcards there are refused
+func ownsInbox(filter string, key []byte) bool {
+	owner, _, _ := strings.Cut(strings.TrimPrefix(filter, InboxTopicPrefix), topic.Separator)
+	return len(key) == crypto.PublicKeySize && owner == hex.EncodeToString(key[:8])
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
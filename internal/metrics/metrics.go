@@ -0,0 +1,226 @@
+// Package metrics is a small Prometheus-compatible metrics registry: counters, gauges
+// and histograms written in the text exposition format, without external dependencies.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds metrics in registration order and serves them on /metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// WriteTo writes every metric in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	ms := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range ms {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func header(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, typ)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	name, help string
+	v          atomic.Uint64
+}
+
+// Counter registers a counter
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	r.add(c)
+	return c
+}
+
+// Inc adds 1
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add adds n
+func (c *Counter) Add(n uint64) { c.v.Add(n) }
+
+// Value returns the current count
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+func (c *Counter) write(w *bufio.Writer) {
+	header(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.v.Load())
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	name, help string
+	v          atomic.Int64
+}
+
+// Gauge registers a gauge
+func (r *Registry) Gauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	r.add(g)
+	return g
+}
+
+// Add adds n (which may be negative)
+func (g *Gauge) Add(n int64) { g.v.Add(n) }
+
+// Set sets the value
+func (g *Gauge) Set(n int64) { g.v.Store(n) }
+
+func (g *Gauge) write(w *bufio.Writer) {
+	header(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.v.Load())
+}
+
+// funcMetric reads its value when scraped
+type funcMetric struct {
+	name, help, typ string
+	fn              func() float64
+}
+
+// GaugeFunc registers a gauge whose value is read from fn on each scrape
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.add(&funcMetric{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// CounterFunc registers a counter whose value is read from fn on each scrape
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.add(&funcMetric{name: name, help: help, typ: "counter", fn: fn})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	header(w, m.name, m.help, m.typ)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.fn()))
+}
+
+// vecFunc is a gauge with one label, read from fn on each scrape
+type vecFunc struct {
+	name, help, label string
+	fn                func() map[string]float64
+}
+
+// GaugeVecFunc registers a gauge with one label; fn returns the value per label value
+func (r *Registry) GaugeVecFunc(name, help, label string, fn func() map[string]float64) {
+	r.add(&vecFunc{name: name, help: help, label: label, fn: fn})
+}
+
+func (m *vecFunc) write(w *bufio.Writer) {
+	header(w, m.name, m.help, "gauge")
+	vals := m.fn()
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", m.name, m.label, labelEscaper.Replace(k), formatFloat(vals[k]))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// DefBuckets are histogram buckets (seconds) for network latencies
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// Histogram registers a histogram with upper bounds buckets (sorted ascending)
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+	r.add(h)
+	return h
+}
+
+// Observe records v
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+	header(w, h.name, h.help, "histogram")
+	var cum uint64
+	for i, b := range h.buckets {
+		cum += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(b), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatFloat(sum), h.name, count)
+}
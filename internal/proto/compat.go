@@ -0,0 +1,292 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// ErrIncompatible is returned when a new schema version breaks the subject's compatibility mode
+var ErrIncompatible = errors.New("incompatible schema version")
+
+// Compatibility is the rule a new schema version must satisfy against its neighbours
+type Compatibility int
+
+const (
+	// CompatBackward: consumers using the new version can read data written with the previous one
+	CompatBackward Compatibility = iota
+	// CompatForward: consumers using the previous version can read data written with the new one
+	CompatForward
+	// CompatFull: both backward and forward
+	CompatFull
+	// CompatNone: no checks
+	CompatNone
+)
+
+func (c Compatibility) String() string {
+	switch c {
+	case CompatBackward:
+		return "backward"
+	case CompatForward:
+		return "forward"
+	case CompatFull:
+		return "full"
+	case CompatNone:
+		return "none"
+	}
+	return "unknown"
+}
+
+// ParseCompatibility parses "backward", "forward", "full" or "none"
+func ParseCompatibility(s string) (Compatibility, error) {
+	switch strings.ToLower(s) {
+	case "backward":
+		return CompatBackward, nil
+	case "forward":
+		return CompatForward, nil
+	case "full":
+		return CompatFull, nil
+	case "none":
+		return CompatNone, nil
+	}
+	return 0, fmt.Errorf("unknown compatibility %q", s)
+}
+
+// ParseSchemaID splits a versioned ID ("sensor.Temperature@2") into name and version.
+// Unversioned IDs return version 0.
+func ParseSchemaID(id string) (name string, version int) {
+	i := strings.LastIndexByte(id, '@')
+	if i < 0 {
+		return id, 0
+	}
+	v, err := strconv.Atoi(id[i+1:])
+	if err != nil || v <= 0 {
+		return id, 0
+	}
+	return id[:i], v
+}
+
+// FormatSchemaID joins a name and version into a versioned ID
+func FormatSchemaID(name string, version int) string {
+	if version <= 0 {
+		return name
+	}
+	return name + "@" + strconv.Itoa(version)
+}
+
+// IncompatibleError lists why a schema version fails a compatibility check
+type IncompatibleError struct {
+	ID       string
+	Against  string
+	Mode     Compatibility
+	Problems []string
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("%s is not %s compatible with %s: %s", e.ID, e.Mode, e.Against, strings.Join(e.Problems, "; "))
+}
+
+func (e *IncompatibleError) Unwrap() error { return ErrIncompatible }
+
+// Shape is the top-level structure of a schema, used for compatibility checks
+type Shape struct {
+	Fields map[string]FieldShape
+	Closed bool // unknown fields are rejected
+}
+
+// FieldShape describes one top-level field
+type FieldShape struct {
+	Type     string // JSON type: string, number, integer, boolean, object, array, or "" for any
+	Required bool
+}
+
+// Describer is implemented by validators that can report their Shape.
+// Validators that don't implement it can only be registered under CompatNone.
+type Describer interface {
+	Shape() *Shape
+}
+
+// readProblems lists why a reader with shape r may reject data written with shape w
+func readProblems(r, w *Shape) []string {
+	var problems []string
+	names := make([]string, 0, len(r.Fields))
+	for name := range r.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rf := r.Fields[name]
+		wf, ok := w.Fields[name]
+		if rf.Required && (!ok || !wf.Required) {
+			problems = append(problems, fmt.Sprintf("field %q is required by the reader but optional for the writer", name))
+		}
+		if ok && !typeReadable(rf.Type, wf.Type) {
+			problems = append(problems, fmt.Sprintf("field %q changed type from %s to %s", name, orAny(wf.Type), orAny(rf.Type)))
+		}
+	}
+	if r.Closed {
+		if !w.Closed {
+			problems = append(problems, "reader rejects unknown fields but the writer allows them")
+		}
+		extra := make([]string, 0)
+		for name := range w.Fields {
+			if _, ok := r.Fields[name]; !ok {
+				extra = append(extra, name)
+			}
+		}
+		sort.Strings(extra)
+		for _, name := range extra {
+			problems = append(problems, fmt.Sprintf("field %q is unknown to the reader", name))
+		}
+	}
+	return problems
+}
+
+func typeReadable(reader, writer string) bool {
+	if reader == "" || reader == writer {
+		return true
+	}
+	return reader == "number" && writer == "integer"
+}
+
+func orAny(t string) string {
+	if t == "" {
+		return "any"
+	}
+	return t
+}
+
+// checkCompatibility reports whether next may follow prev under mode
+func checkCompatibility(mode Compatibility, prev, next Validator) ([]string, error) {
+	if mode == CompatNone {
+		return nil, nil
+	}
+	pd, ok1 := prev.(Describer)
+	nd, ok2 := next.(Describer)
+	if !ok1 || !ok2 {
+		return nil, errors.New("validator does not describe its shape; register with CompatNone")
+	}
+	ps, ns := pd.Shape(), nd.Shape()
+	var problems []string
+	if mode == CompatBackward || mode == CompatFull {
+		problems = append(problems, readProblems(ns, ps)...)
+	}
+	if mode == CompatForward || mode == CompatFull {
+		problems = append(problems, readProblems(ps, ns)...)
+	}
+	return problems, nil
+}
+
+// Shape implements Describer from the struct's json tags
+func (s structValidator) Shape() *Shape {
+	sh := &Shape{Fields: make(map[string]FieldShape)}
+	for i := 0; i < s.t.NumField(); i++ {
+		f := s.t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		sh.Fields[name] = FieldShape{Type: goJSONType(f.Type)}
+	}
+	return sh
+}
+
+func goJSONType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string" // []byte is base64
+		}
+		return "array"
+	case reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return ""
+}
+
+// Shape implements Describer from the root schema's properties
+func (s *JSONSchema) Shape() *Shape {
+	n := s.root
+	for n.ref != nil && n.properties == nil {
+		n = n.ref
+	}
+	sh := &Shape{Fields: make(map[string]FieldShape)}
+	for name, p := range n.properties {
+		fs := FieldShape{}
+		if len(p.types) == 1 {
+			fs.Type = p.types[0]
+		}
+		sh.Fields[name] = fs
+	}
+	for _, name := range n.required {
+		fs := sh.Fields[name]
+		fs.Required = true
+		sh.Fields[name] = fs
+	}
+	sh.Closed = n.additional != nil && n.additional.always != nil && !*n.additional.always && n.patternProperties == nil
+	return sh
+}
+
+// Shape implements Describer from the message fields. protojson rejects unknown fields.
+func (d descriptorValidator) Shape() *Shape {
+	sh := &Shape{Fields: make(map[string]FieldShape), Closed: true}
+	fields := d.md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		f := fields.Get(i)
+		sh.Fields[string(f.Name())] = FieldShape{Type: protoJSONType(f)}
+	}
+	return sh
+}
+
+func protoJSONType(f protoreflect.FieldDescriptor) string {
+	if f.IsList() {
+		return "array"
+	}
+	if f.IsMap() {
+		return "object"
+	}
+	switch f.Kind() {
+	case protoreflect.BoolKind:
+		return "boolean"
+	case protoreflect.StringKind, protoreflect.BytesKind, protoreflect.EnumKind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return "" // protojson accepts these as strings or numbers
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return "integer"
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return "number"
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return "object"
+	}
+	return ""
+}
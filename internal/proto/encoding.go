@@ -0,0 +1,187 @@
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Encoding is the payload encoding declared next to SchemaID on the wire
+type Encoding string
+
+const (
+	// EncodingJSON is the default; an empty Encoding means JSON
+	EncodingJSON Encoding = "json"
+	// EncodingProtobuf is the protobuf binary form of the schema's message descriptor
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+// ParseEncoding parses "json", "protobuf" (or "pb"); "" is JSON
+func ParseEncoding(s string) (Encoding, error) {
+	switch s {
+	case "", "json":
+		return EncodingJSON, nil
+	case "protobuf", "pb":
+		return EncodingProtobuf, nil
+	}
+	return "", fmt.Errorf("unknown encoding %q", s)
+}
+
+// orJSON maps the empty encoding to EncodingJSON
+func (e Encoding) orJSON() Encoding {
+	if e == "" {
+		return EncodingJSON
+	}
+	return e
+}
+
+// AttachDescriptor declares the protobuf message type of a registered schema,
+// allowing EncodingProtobuf payloads for it. Descriptor-registered schemas have one already.
+func (r *SchemaRegistry) AttachDescriptor(id string, md protoreflect.MessageDescriptor) error {
+	if md == nil {
+		return fmt.Errorf("schema %s: nil descriptor", id)
+	}
+	name, version := ParseSchemaID(id)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub, ok := r.subjects[name]
+	if !ok {
+		return fmt.Errorf("unknown schema: %s", id)
+	}
+	if version == 0 {
+		version = sub.latest
+	}
+	if _, ok := sub.versions[version]; !ok {
+		return fmt.Errorf("unknown schema: %s", id)
+	}
+	if sub.descs == nil {
+		sub.descs = make(map[int]protoreflect.MessageDescriptor)
+	}
+	sub.descs[version] = md
+	return nil
+}
+
+// Descriptor returns the protobuf message type of id, if it has one
+func (r *SchemaRegistry) Descriptor(id string) (protoreflect.MessageDescriptor, bool) {
+	name, version := ParseSchemaID(id)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subjects[name]
+	if !ok {
+		return nil, false
+	}
+	if version == 0 {
+		version = sub.latest
+	}
+	if md, ok := sub.descs[version]; ok {
+		return md, true
+	}
+	if d, ok := sub.versions[version].(descriptorValidator); ok {
+		return d.md, true
+	}
+	return nil, false
+}
+
+// ValidateEncoded checks a payload in the given encoding. Protobuf payloads are
+// decoded with the schema's descriptor and then validated like their JSON form,
+// so both encodings obey the same rules.
+func (r *SchemaRegistry) ValidateEncoded(id string, enc Encoding, payload []byte) error {
+	switch enc.orJSON() {
+	case EncodingJSON:
+		return r.Validate(id, payload)
+	case EncodingProtobuf:
+		js, err := r.Transcode(id, EncodingProtobuf, EncodingJSON, payload)
+		if err != nil {
+			return err
+		}
+		return r.Validate(id, js)
+	default:
+		return fmt.Errorf("unknown encoding %q", enc)
+	}
+}
+
+// Transcode converts a payload of schema id between encodings.
+// JSON output uses proto field names (matching the Go struct tags) and plain JSON numbers.
+func (r *SchemaRegistry) Transcode(id string, from, to Encoding, payload []byte) ([]byte, error) {
+	from, to = from.orJSON(), to.orJSON()
+	if from == to {
+		return payload, nil
+	}
+	md, ok := r.Descriptor(id)
+	if !ok {
+		if !r.Has(id) {
+			return nil, fmt.Errorf("unknown schema: %s", id)
+		}
+		return nil, fmt.Errorf("schema %s has no protobuf descriptor", id)
+	}
+	msg := dynamicpb.NewMessage(md)
+	switch {
+	case from == EncodingJSON && to == EncodingProtobuf:
+		if err := protojson.Unmarshal(payload, msg); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", md.Name(), err)
+		}
+		return gproto.Marshal(msg)
+	case from == EncodingProtobuf && to == EncodingJSON:
+		if err := gproto.Unmarshal(payload, msg); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", md.Name(), err)
+		}
+		return json.Marshal(messageToJSON(msg))
+	}
+	return nil, fmt.Errorf("cannot transcode %s to %s", from, to)
+}
+
+// messageToJSON converts a message to plain JSON values. Unlike protojson it keeps
+// 64-bit integers as numbers and uses proto field names, so the result decodes into
+// the Go structs in this package. Unset scalar fields are emitted with their zero
+// value, since proto3 cannot distinguish them from explicit zeros (e.g. 0°C).
+func messageToJSON(m protoreflect.Message) map[string]interface{} {
+	out := make(map[string]interface{})
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !m.Has(fd) && (fd.Message() != nil && !fd.IsList() && !fd.IsMap() || fd.ContainingOneof() != nil) {
+			continue
+		}
+		out[string(fd.Name())] = fieldToJSON(fd, m.Get(fd))
+	}
+	return out
+}
+
+func fieldToJSON(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch {
+	case fd.IsList():
+		list := v.List()
+		out := make([]interface{}, list.Len())
+		for i := range out {
+			out[i] = scalarToJSON(fd, list.Get(i))
+		}
+		return out
+	case fd.IsMap():
+		out := make(map[string]interface{})
+		v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+			out[k.String()] = scalarToJSON(fd.MapValue(), mv)
+			return true
+		})
+		return out
+	}
+	return scalarToJSON(fd, v)
+}
+
+func scalarToJSON(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return messageToJSON(v.Message())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int32(v.Enum())
+	case protoreflect.BytesKind:
+		return v.Bytes() // base64, as protojson expects
+	}
+	return v.Interface()
+}
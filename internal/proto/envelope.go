@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Header names with a common meaning
+const (
+	HeaderContentType = "content-type"
+	HeaderTimestamp   = "timestamp"   // publisher's send time, RFC 3339
+	HeaderTraceparent = "traceparent" // W3C trace context of the publish
+)
+
+// Limits on cleartext routing headers, which the relay reads and forwards
+const (
+	MaxRoutingHeaders     = 16
+	MaxRoutingHeaderBytes = 1024 // sum of key and value lengths
+)
+
+// Envelope is the plaintext sealed into a payload that carries headers: the relay
+// sees neither. Messages without headers seal the bare payload (Envelope false on the frame).
+type Envelope struct {
+	Headers map[string]string `json:"h,omitempty"`
+	Payload []byte            `json:"p"`
+}
+
+// MarshalEnvelope encodes headers and payload for sealing
+func MarshalEnvelope(headers map[string]string, payload []byte) ([]byte, error) {
+	return json.Marshal(Envelope{Headers: headers, Payload: payload})
+}
+
+// UnmarshalEnvelope decodes an opened envelope
+func UnmarshalEnvelope(b []byte) (*Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("envelope: %w", err)
+	}
+	return &e, nil
+}
+
+// ValidateRoutingHeaders checks the cleartext headers of a Publish: at most
+// MaxRoutingHeaders non-empty keys totalling MaxRoutingHeaderBytes
+func ValidateRoutingHeaders(h map[string]string) error {
+	if len(h) > MaxRoutingHeaders {
+		return fmt.Errorf("%d routing headers, at most %d allowed", len(h), MaxRoutingHeaders)
+	}
+	size := 0
+	for k, v := range h {
+		if k == "" {
+			return fmt.Errorf("empty routing header name")
+		}
+		size += len(k) + len(v)
+	}
+	if size > MaxRoutingHeaderBytes {
+		return fmt.Errorf("routing headers are %d bytes, at most %d allowed", size, MaxRoutingHeaderBytes)
+	}
+	return nil
+}
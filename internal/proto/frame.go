@@ -3,9 +3,17 @@ package proto
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// MaxFrameSize is the largest frame body Decode accepts
+const MaxFrameSize = 1024 * 1024
+
+// ErrMalformedFrame is returned by Decode for a frame that is too large or not valid JSON
+var ErrMalformedFrame = errors.New("malformed frame")
+
 // Frame types
 const (
 	FrameTypePublish   = 1
@@ -15,6 +23,12 @@ const (
 	FrameTypeAck       = 5
 	FrameTypeError     = 6
 	FrameTypeDiscovery = 7
+	FrameTypeConnect   = 8
+	FrameTypeChallenge = 9
+	FrameTypeProve     = 10
+	FrameTypeDisconnect = 11
+	FrameTypeAuth       = 12
+	FrameTypeGoAway     = 13
 )
 
 // PublishFrame is sent when publishing to a topic
@@ -24,6 +38,12 @@ type PublishFrame struct {
 	SchemaID        string `json:"schema_id"`
 	RecipientKeyID  []byte `json:"recipient_key_id"`
 	SenderPublicKey []byte `json:"sender_public_key"` // for relay to forward (zero-knowledge routing)
+	Encoding        Encoding `json:"encoding,omitempty"` // payload encoding; empty means JSON
+	Retain          bool     `json:"retain,omitempty"`   // relay keeps it as the topic's last value; an empty payload clears it
+	ReplyTo         string   `json:"reply_to,omitempty"`       // topic the recipient should reply on (request/reply)
+	CorrelationID   string   `json:"correlation_id,omitempty"` // matches a reply to its request
+	Envelope        bool              `json:"envelope,omitempty"` // payload seals an Envelope (headers + payload)
+	Headers         map[string]string `json:"headers,omitempty"`  // cleartext routing headers, visible to the relay
 }
 
 // SubscribeFrame registers interest in a topic
@@ -31,11 +51,14 @@ type SubscribeFrame struct {
 	Topic     string `json:"topic"`
 	SchemaID  string `json:"schema_id"`
 	PublicKey []byte `json:"public_key"`
+	Group     string `json:"group,omitempty"` // shared subscription: each message goes to one member of the group
+	Persistent bool  `json:"persistent,omitempty"` // relay queues messages while the subscriber is offline (requires Connect)
 }
 
 // UnsubscribeFrame
 type UnsubscribeFrame struct {
 	Topic string `json:"topic"`
+	Group string `json:"group,omitempty"`
 }
 
 // MessageFrame - relayed message (relay forwards without reading payload)
@@ -44,6 +67,14 @@ type MessageFrame struct {
 	EncryptedPayload []byte `json:"encrypted_payload"`
 	SenderKeyID      []byte `json:"sender_key_id"`
 	SenderPublicKey  []byte `json:"sender_public_key"` // needed for box.Open
+	SchemaID         string `json:"schema_id,omitempty"` // writer's schema, for subscriber-side version negotiation
+	Encoding         Encoding `json:"encoding,omitempty"`
+	Retained         bool     `json:"retained,omitempty"` // replayed retained value, sent on Subscribe
+	System           bool     `json:"system,omitempty"`   // generated by the relay (e.g. presence); payload is not encrypted
+	ReplyTo          string   `json:"reply_to,omitempty"`       // copied from Publish
+	CorrelationID    string   `json:"correlation_id,omitempty"` // copied from Publish
+	Envelope         bool              `json:"envelope,omitempty"` // copied from Publish
+	Headers          map[string]string `json:"headers,omitempty"`  // copied from Publish
 }
 
 // AckFrame
@@ -54,8 +85,45 @@ type AckFrame struct {
 
 // ErrorFrame
 type ErrorFrame struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"` // RATE_LIMITED: when to try again
+}
+
+// ConnectFrame starts a relay session and claims a public key; the relay answers
+// with a ChallengeFrame
+type ConnectFrame struct {
+	NodeID    string `json:"node_id,omitempty"`
+	PublicKey []byte `json:"public_key"`
+	Will      *PublishFrame `json:"will,omitempty"`     // published by the relay if the connection drops without a Disconnect
+	Presence  bool          `json:"presence,omitempty"` // relay maintains $presence/<node_id> for this connection
+	Token     string        `json:"token,omitempty"`    // bearer token for the relay's authenticator
+}
+
+// ChallengeFrame asks the client to prove it holds the private key of its ConnectFrame
+type ChallengeFrame struct {
+	Nonce     []byte `json:"nonce"`
+	PublicKey []byte `json:"public_key"` // relay's one-time public key
+}
+
+// ProveFrame answers a challenge: the nonce sealed (NaCl box) for the relay's one-time key
+type ProveFrame struct {
+	Proof []byte `json:"proof"`
+}
+
+// DisconnectFrame announces a clean close: the relay discards the will and acknowledges
+type DisconnectFrame struct{}
+
+// AuthFrame replaces the credentials of a proven connection (e.g. a refreshed token)
+type AuthFrame struct {
+	Token string `json:"token"`
+}
+
+// GoAwayFrame tells a client the relay is shutting down: it should reconnect (to
+// another relay) for new requests and close this connection once its pending
+// requests are answered. It follows the Message frames already queued.
+type GoAwayFrame struct {
+	Reason string `json:"reason,omitempty"`
 }
 
 // DiscoveryFrame - P2P discovery
@@ -76,37 +144,54 @@ type Frame struct {
 	Ack       *AckFrame       `json:"a,omitempty"`
 	Error     *ErrorFrame     `json:"e,omitempty"`
 	Discovery *DiscoveryFrame `json:"d,omitempty"`
+	Connect   *ConnectFrame   `json:"c,omitempty"`
+	Challenge *ChallengeFrame `json:"ch,omitempty"`
+	Prove     *ProveFrame     `json:"pv,omitempty"`
+	Disconnect *DisconnectFrame `json:"dc,omitempty"`
+	Auth       *AuthFrame       `json:"au,omitempty"`
+	GoAway     *GoAwayFrame     `json:"ga,omitempty"`
 }
 
-// Encode writes a length-prefixed JSON frame to w
+// Encode writes a length-prefixed JSON frame to w in a single Write
 func (f *Frame) Encode(w io.Writer) error {
-	data, err := json.Marshal(f)
+	buf, err := f.Marshal()
 	if err != nil {
 		return err
 	}
-	// 4-byte big-endian length prefix
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
-	if _, err := w.Write(lenBuf); err != nil {
-		return err
-	}
-	_, err = w.Write(data)
+	_, err = w.Write(buf)
 	return err
 }
 
-// Decode reads a length-prefixed JSON frame from r
+// Marshal returns the length-prefixed JSON encoding of f, as written by Encode
+func (f *Frame) Marshal() ([]byte, error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	// 4-byte big-endian length prefix
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	return append(buf, data...), nil
+}
+
+// Decode reads a length-prefixed JSON frame from r. f is reset first, so slices
+// from a previously decoded frame stay valid when the same Frame is reused.
 func (f *Frame) Decode(r io.Reader) error {
+	*f = Frame{}
 	var lenBuf [4]byte
 	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
 		return err
 	}
 	length := binary.BigEndian.Uint32(lenBuf[:])
-	if length > 1024*1024 { // 1MB max
-		return io.ErrShortBuffer
+	if length > MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrMalformedFrame, length, MaxFrameSize)
 	}
 	data := make([]byte, length)
 	if _, err := io.ReadFull(r, data); err != nil {
 		return err
 	}
-	return json.Unmarshal(data, f)
+	if err := json.Unmarshal(data, f); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+	}
+	return nil
 }
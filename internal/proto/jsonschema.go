@@ -0,0 +1,1010 @@
+package proto
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONSchema is a compiled JSON Schema (draft 2020-12) document.
+//
+// Supported: type, enum, const, numeric and string/array/object bounds, pattern,
+// properties, patternProperties, additionalProperties, propertyNames, required,
+// dependentRequired, dependentSchemas, items, prefixItems, contains, allOf, anyOf,
+// oneOf, not, if/then/else, $defs, $anchor and $ref within the same document.
+// "format" is treated as an annotation. unevaluated*, $dynamicRef and remote
+// $ref are rejected at compile time rather than silently ignored, as are $ref cycles
+// that apply a schema to the same value again (which would never terminate).
+type JSONSchema struct {
+	root *schemaNode
+}
+
+// ValidationError is a single schema violation
+type ValidationError struct {
+	Path    string // JSON path of the offending value, e.g. $.readings[2].celsius
+	Keyword string // schema keyword that failed, e.g. "maximum"
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationErrors lists every violation found in a payload
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type schemaNode struct {
+	always *bool // boolean schema
+
+	ref *schemaNode
+
+	types  []string
+	enum   []interface{}
+	cnst   interface{}
+	hasCst bool
+
+	multipleOf       *big.Rat
+	maximum          *bound
+	exclusiveMaximum *bound
+	minimum          *bound
+	exclusiveMinimum *bound
+
+	maxLength int
+	minLength int
+	pattern   *regexp.Regexp
+
+	items       *schemaNode
+	prefixItems []*schemaNode
+	contains    *schemaNode
+	minContains int
+	maxContains int
+	maxItems    int
+	minItems    int
+	uniqueItems bool
+
+	properties        map[string]*schemaNode
+	patternProperties map[*regexp.Regexp]*schemaNode
+	additional        *schemaNode
+	propertyNames     *schemaNode
+	required          []string
+	dependentRequired map[string][]string
+	dependentSchemas  map[string]*schemaNode
+	maxProperties     int
+	minProperties     int
+
+	allOf []*schemaNode
+	anyOf []*schemaNode
+	oneOf []*schemaNode
+	not   *schemaNode
+	ifS   *schemaNode
+	thenS *schemaNode
+	elseS *schemaNode
+}
+
+// unsupportedKeywords fail compilation so a schema never validates more loosely than written
+var unsupportedKeywords = []string{"unevaluatedProperties", "unevaluatedItems", "$dynamicRef", "$recursiveRef"}
+
+type schemaCompiler struct {
+	root    interface{}
+	baseID  string
+	byPtr   map[string]*schemaNode
+	anchors map[string]string // anchor name -> JSON pointer
+}
+
+// CompileJSONSchema parses a JSON Schema document
+func CompileJSONSchema(doc []byte) (*JSONSchema, error) {
+	raw, err := decodeJSON(doc)
+	if err != nil {
+		return nil, fmt.Errorf("json schema: %w", err)
+	}
+	c := &schemaCompiler{
+		root:    raw,
+		byPtr:   make(map[string]*schemaNode),
+		anchors: make(map[string]string),
+	}
+	if m, ok := raw.(map[string]interface{}); ok {
+		if id, ok := m["$id"].(string); ok {
+			c.baseID = strings.TrimSuffix(id, "#")
+		}
+	}
+	c.collectAnchors(raw, "")
+	root, err := c.compile(raw, "")
+	if err != nil {
+		return nil, fmt.Errorf("json schema: %w", err)
+	}
+	if err := c.checkCycles(); err != nil {
+		return nil, fmt.Errorf("json schema: %w", err)
+	}
+	return &JSONSchema{root: root}, nil
+}
+
+// checkCycles rejects schemas that reach themselves through $ref and in-place
+// applicators (allOf, not, if, ...) without descending into the value: validating
+// against them would recurse forever
+func (c *schemaCompiler) checkCycles() error {
+	ptrs := make([]string, 0, len(c.byPtr))
+	for p := range c.byPtr {
+		ptrs = append(ptrs, p)
+	}
+	sort.Strings(ptrs) // report the same pointer every time
+	at := make(map[*schemaNode]string, len(c.byPtr))
+	for _, p := range ptrs {
+		at[c.byPtr[p]] = p
+	}
+	const visiting, done = 1, 2
+	state := make(map[*schemaNode]int)
+	var visit func(n *schemaNode) error
+	visit = func(n *schemaNode) error {
+		switch state[n] {
+		case visiting:
+			return fmt.Errorf("%s: $ref cycle that does not consume input", pointerOrRoot(at[n]))
+		case done:
+			return nil
+		}
+		state[n] = visiting
+		for _, next := range n.inPlace() {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		state[n] = done
+		return nil
+	}
+	for _, p := range ptrs {
+		if err := visit(c.byPtr[p]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inPlace returns the subschemas n applies to the value itself rather than to
+// its items, properties or property names
+func (n *schemaNode) inPlace() []*schemaNode {
+	var out []*schemaNode
+	for _, s := range []*schemaNode{n.ref, n.not, n.ifS, n.thenS, n.elseS} {
+		if s != nil {
+			out = append(out, s)
+		}
+	}
+	out = append(out, n.allOf...)
+	out = append(out, n.anyOf...)
+	out = append(out, n.oneOf...)
+	for _, s := range n.dependentSchemas {
+		out = append(out, s)
+	}
+	return out
+}
+
+func (c *schemaCompiler) collectAnchors(raw interface{}, ptr string) {
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		if a, ok := v["$anchor"].(string); ok {
+			c.anchors[a] = ptr
+		}
+		for k, child := range v {
+			c.collectAnchors(child, ptr+"/"+escapePointer(k))
+		}
+	case []interface{}:
+		for i, child := range v {
+			c.collectAnchors(child, ptr+"/"+strconv.Itoa(i))
+		}
+	}
+}
+
+func (c *schemaCompiler) compile(raw interface{}, ptr string) (*schemaNode, error) {
+	if n, ok := c.byPtr[ptr]; ok {
+		return n, nil
+	}
+	n := &schemaNode{maxLength: -1, maxItems: -1, maxProperties: -1, maxContains: -1, minContains: 1}
+	c.byPtr[ptr] = n // registered before children so recursive $refs terminate
+
+	switch v := raw.(type) {
+	case bool:
+		n.always = &v
+		return n, nil
+	case map[string]interface{}:
+		if err := c.compileObject(n, v, ptr); err != nil {
+			return nil, err
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("%s: schema must be an object or boolean", pointerOrRoot(ptr))
+	}
+}
+
+func (c *schemaCompiler) compileObject(n *schemaNode, m map[string]interface{}, ptr string) error {
+	at := pointerOrRoot(ptr)
+	for _, kw := range unsupportedKeywords {
+		if _, ok := m[kw]; ok {
+			return fmt.Errorf("%s: keyword %q not supported", at, kw)
+		}
+	}
+	sub := func(key string, raw interface{}) (*schemaNode, error) {
+		return c.compile(raw, ptr+"/"+escapePointer(key))
+	}
+	subList := func(key string) ([]*schemaNode, error) {
+		raw, ok := m[key]
+		if !ok {
+			return nil, nil
+		}
+		list, ok := raw.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("%s: %s must be a non-empty array", at, key)
+		}
+		out := make([]*schemaNode, len(list))
+		for i, item := range list {
+			s, err := c.compile(item, ptr+"/"+key+"/"+strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = s
+		}
+		return out, nil
+	}
+	var err error
+
+	if ref, ok := m["$ref"].(string); ok {
+		target, err := c.resolveRef(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %w", at, err)
+		}
+		n.ref = target
+	}
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		n.types = []string{t}
+	case []interface{}:
+		for _, x := range t {
+			s, ok := x.(string)
+			if !ok {
+				return fmt.Errorf("%s: type must be a string or array of strings", at)
+			}
+			n.types = append(n.types, s)
+		}
+	default:
+		return fmt.Errorf("%s: type must be a string or array of strings", at)
+	}
+	for _, t := range n.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return fmt.Errorf("%s: unknown type %q", at, t)
+		}
+	}
+	if e, ok := m["enum"]; ok {
+		list, ok := e.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: enum must be an array", at)
+		}
+		n.enum = list
+	}
+	if cst, ok := m["const"]; ok {
+		n.cnst, n.hasCst = cst, true
+	}
+
+	if raw, ok := m["multipleOf"]; ok {
+		r, ok := toRat(raw)
+		if !ok || r.Sign() <= 0 {
+			return fmt.Errorf("%s: multipleOf must be a number greater than 0", at)
+		}
+		n.multipleOf = r
+	}
+	for key, dst := range map[string]**bound{
+		"maximum":          &n.maximum,
+		"exclusiveMaximum": &n.exclusiveMaximum,
+		"minimum":          &n.minimum,
+		"exclusiveMinimum": &n.exclusiveMinimum,
+	} {
+		if raw, ok := m[key]; ok {
+			r, ok := toRat(raw)
+			if !ok {
+				return fmt.Errorf("%s: %s must be a number", at, key)
+			}
+			*dst = &bound{decimal: parseDecimal(raw.(json.Number)), text: ratString(r)}
+		}
+	}
+
+	for key, dst := range map[string]*int{
+		"maxLength":     &n.maxLength,
+		"minLength":     &n.minLength,
+		"maxItems":      &n.maxItems,
+		"minItems":      &n.minItems,
+		"maxProperties": &n.maxProperties,
+		"minProperties": &n.minProperties,
+		"maxContains":   &n.maxContains,
+		"minContains":   &n.minContains,
+	} {
+		if raw, ok := m[key]; ok {
+			r, ok := toRat(raw)
+			if !ok || !r.IsInt() || r.Sign() < 0 {
+				return fmt.Errorf("%s: %s must be a non-negative integer", at, key)
+			}
+			*dst = int(r.Num().Int64())
+		}
+	}
+
+	if p, ok := m["pattern"].(string); ok {
+		if n.pattern, err = regexp.Compile(p); err != nil {
+			return fmt.Errorf("%s: pattern: %w", at, err)
+		}
+	}
+	if u, ok := m["uniqueItems"].(bool); ok {
+		n.uniqueItems = u
+	}
+
+	if raw, ok := m["items"]; ok {
+		if _, isList := raw.([]interface{}); isList {
+			return fmt.Errorf("%s: items must be a schema (use prefixItems for tuples)", at)
+		}
+		if n.items, err = sub("items", raw); err != nil {
+			return err
+		}
+	}
+	if n.prefixItems, err = subList("prefixItems"); err != nil {
+		return err
+	}
+	if raw, ok := m["contains"]; ok {
+		if n.contains, err = sub("contains", raw); err != nil {
+			return err
+		}
+	}
+
+	if raw, ok := m["properties"]; ok {
+		props, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: properties must be an object", at)
+		}
+		n.properties = make(map[string]*schemaNode, len(props))
+		for name, p := range props {
+			if n.properties[name], err = c.compile(p, ptr+"/properties/"+escapePointer(name)); err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := m["patternProperties"]; ok {
+		props, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: patternProperties must be an object", at)
+		}
+		n.patternProperties = make(map[*regexp.Regexp]*schemaNode, len(props))
+		for expr, p := range props {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("%s: patternProperties: %w", at, err)
+			}
+			if n.patternProperties[re], err = c.compile(p, ptr+"/patternProperties/"+escapePointer(expr)); err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := m["additionalProperties"]; ok {
+		if n.additional, err = sub("additionalProperties", raw); err != nil {
+			return err
+		}
+	}
+	if raw, ok := m["propertyNames"]; ok {
+		if n.propertyNames, err = sub("propertyNames", raw); err != nil {
+			return err
+		}
+	}
+	if raw, ok := m["required"]; ok {
+		if n.required, err = toStrings(raw); err != nil {
+			return fmt.Errorf("%s: required %w", at, err)
+		}
+	}
+	if raw, ok := m["dependentRequired"]; ok {
+		deps, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: dependentRequired must be an object", at)
+		}
+		n.dependentRequired = make(map[string][]string, len(deps))
+		for name, d := range deps {
+			if n.dependentRequired[name], err = toStrings(d); err != nil {
+				return fmt.Errorf("%s: dependentRequired %w", at, err)
+			}
+		}
+	}
+	if raw, ok := m["dependentSchemas"]; ok {
+		deps, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: dependentSchemas must be an object", at)
+		}
+		n.dependentSchemas = make(map[string]*schemaNode, len(deps))
+		for name, d := range deps {
+			if n.dependentSchemas[name], err = c.compile(d, ptr+"/dependentSchemas/"+escapePointer(name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.allOf, err = subList("allOf"); err != nil {
+		return err
+	}
+	if n.anyOf, err = subList("anyOf"); err != nil {
+		return err
+	}
+	if n.oneOf, err = subList("oneOf"); err != nil {
+		return err
+	}
+	if raw, ok := m["not"]; ok {
+		if n.not, err = sub("not", raw); err != nil {
+			return err
+		}
+	}
+	if raw, ok := m["if"]; ok {
+		if n.ifS, err = sub("if", raw); err != nil {
+			return err
+		}
+		if raw, ok := m["then"]; ok {
+			if n.thenS, err = sub("then", raw); err != nil {
+				return err
+			}
+		}
+		if raw, ok := m["else"]; ok {
+			if n.elseS, err = sub("else", raw); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveRef compiles the target of a same-document $ref
+func (c *schemaCompiler) resolveRef(ref string) (*schemaNode, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("$ref %q: %w", ref, err)
+	}
+	frag := u.Fragment
+	u.Fragment = ""
+	if base := u.String(); base != "" && base != c.baseID {
+		return nil, fmt.Errorf("$ref %q: remote references not supported", ref)
+	}
+	ptr := frag
+	if frag != "" && !strings.HasPrefix(frag, "/") {
+		p, ok := c.anchors[frag]
+		if !ok {
+			return nil, fmt.Errorf("$ref %q: unknown anchor", ref)
+		}
+		ptr = p
+	}
+	raw, err := lookupPointer(c.root, ptr)
+	if err != nil {
+		return nil, fmt.Errorf("$ref %q: %w", ref, err)
+	}
+	return c.compile(raw, ptr)
+}
+
+// Validate checks that payload is JSON matching the schema.
+// Violations are returned as ValidationErrors.
+func (s *JSONSchema) Validate(payload []byte) error {
+	v, err := decodeJSON(payload)
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	var errs ValidationErrors
+	s.root.validate(v, "$", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (n *schemaNode) valid(v interface{}) bool {
+	var errs ValidationErrors
+	n.validate(v, "$", &errs)
+	return len(errs) == 0
+}
+
+func (n *schemaNode) validate(v interface{}, path string, errs *ValidationErrors) {
+	fail := func(kw, format string, args ...interface{}) {
+		*errs = append(*errs, &ValidationError{Path: path, Keyword: kw, Message: fmt.Sprintf(format, args...)})
+	}
+	if n.always != nil {
+		if !*n.always {
+			fail("false", "no value allowed here")
+		}
+		return
+	}
+	if n.ref != nil {
+		n.ref.validate(v, path, errs)
+	}
+	if len(n.types) > 0 {
+		ok := false
+		for _, t := range n.types {
+			if jsonTypeMatches(t, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("type", "expected %s, got %s", strings.Join(n.types, " or "), jsonTypeOf(v))
+			return
+		}
+	}
+	if n.enum != nil {
+		ok := false
+		for _, e := range n.enum {
+			if jsonEqual(e, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("enum", "value %s not in enum %s", compactJSON(v), compactJSON(n.enum))
+		}
+	}
+	if n.hasCst && !jsonEqual(n.cnst, v) {
+		fail("const", "value must be %s", compactJSON(n.cnst))
+	}
+
+	switch x := v.(type) {
+	case json.Number:
+		n.validateNumber(x, fail)
+	case string:
+		length := utf8.RuneCountInString(x)
+		if n.maxLength >= 0 && length > n.maxLength {
+			fail("maxLength", "string longer than %d characters", n.maxLength)
+		}
+		if length < n.minLength {
+			fail("minLength", "string shorter than %d characters", n.minLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(x) {
+			fail("pattern", "string does not match pattern %q", n.pattern.String())
+		}
+	case []interface{}:
+		n.validateArray(x, path, errs, fail)
+	case map[string]interface{}:
+		n.validateObject(x, path, errs, fail)
+	}
+
+	for _, s := range n.allOf {
+		s.validate(v, path, errs)
+	}
+	if n.anyOf != nil {
+		ok := false
+		for _, s := range n.anyOf {
+			if s.valid(v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("anyOf", "value does not match any schema in anyOf")
+		}
+	}
+	if n.oneOf != nil {
+		matches := 0
+		for _, s := range n.oneOf {
+			if s.valid(v) {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("oneOf", "value matches %d schemas in oneOf, want exactly 1", matches)
+		}
+	}
+	if n.not != nil && n.not.valid(v) {
+		fail("not", "value must not match schema in not")
+	}
+	if n.ifS != nil {
+		if n.ifS.valid(v) {
+			if n.thenS != nil {
+				n.thenS.validate(v, path, errs)
+			}
+		} else if n.elseS != nil {
+			n.elseS.validate(v, path, errs)
+		}
+	}
+}
+
+// validateNumber compares payload numbers as decimals; only multipleOf needs a
+// big.Rat, and then only for numbers of bounded size
+func (n *schemaNode) validateNumber(x json.Number, fail func(kw, format string, args ...interface{})) {
+	d := parseDecimal(x)
+	if n.multipleOf != nil {
+		if r, ok := d.rat(); !ok {
+			fail("multipleOf", "%s is too large or too precise to check multipleOf", x)
+		} else if !new(big.Rat).Quo(r, n.multipleOf).IsInt() {
+			fail("multipleOf", "%s is not a multiple of %s", x, ratString(n.multipleOf))
+		}
+	}
+	if n.maximum != nil && d.cmp(n.maximum.decimal) > 0 {
+		fail("maximum", "%s is greater than maximum %s", x, n.maximum.text)
+	}
+	if n.exclusiveMaximum != nil && d.cmp(n.exclusiveMaximum.decimal) >= 0 {
+		fail("exclusiveMaximum", "%s must be less than %s", x, n.exclusiveMaximum.text)
+	}
+	if n.minimum != nil && d.cmp(n.minimum.decimal) < 0 {
+		fail("minimum", "%s is less than minimum %s", x, n.minimum.text)
+	}
+	if n.exclusiveMinimum != nil && d.cmp(n.exclusiveMinimum.decimal) <= 0 {
+		fail("exclusiveMinimum", "%s must be greater than %s", x, n.exclusiveMinimum.text)
+	}
+}
+
+func (n *schemaNode) validateArray(x []interface{}, path string, errs *ValidationErrors, fail func(kw, format string, args ...interface{})) {
+	if n.maxItems >= 0 && len(x) > n.maxItems {
+		fail("maxItems", "array has more than %d items", n.maxItems)
+	}
+	if len(x) < n.minItems {
+		fail("minItems", "array has fewer than %d items", n.minItems)
+	}
+	if n.uniqueItems {
+	outer:
+		for i := range x {
+			for j := i + 1; j < len(x); j++ {
+				if jsonEqual(x[i], x[j]) {
+					fail("uniqueItems", "items %d and %d are equal", i, j)
+					break outer
+				}
+			}
+		}
+	}
+	for i, item := range x {
+		itemPath := path + "[" + strconv.Itoa(i) + "]"
+		if i < len(n.prefixItems) {
+			n.prefixItems[i].validate(item, itemPath, errs)
+		} else if n.items != nil {
+			n.items.validate(item, itemPath, errs)
+		}
+	}
+	if n.contains != nil {
+		count := 0
+		for _, item := range x {
+			if n.contains.valid(item) {
+				count++
+			}
+		}
+		if count < n.minContains {
+			fail("contains", "array must contain at least %d matching items, has %d", n.minContains, count)
+		}
+		if n.maxContains >= 0 && count > n.maxContains {
+			fail("maxContains", "array must contain at most %d matching items, has %d", n.maxContains, count)
+		}
+	}
+}
+
+func (n *schemaNode) validateObject(x map[string]interface{}, path string, errs *ValidationErrors, fail func(kw, format string, args ...interface{})) {
+	if n.maxProperties >= 0 && len(x) > n.maxProperties {
+		fail("maxProperties", "object has more than %d properties", n.maxProperties)
+	}
+	if len(x) < n.minProperties {
+		fail("minProperties", "object has fewer than %d properties", n.minProperties)
+	}
+	for _, name := range n.required {
+		if _, ok := x[name]; !ok {
+			fail("required", "missing required property %q", name)
+		}
+	}
+	names := make([]string, 0, len(x))
+	for name := range x {
+		names = append(names, name)
+	}
+	sort.Strings(names) // stable error order
+	for _, name := range names {
+		if deps, ok := n.dependentRequired[name]; ok {
+			for _, d := range deps {
+				if _, ok := x[d]; !ok {
+					fail("dependentRequired", "property %q requires property %q", name, d)
+				}
+			}
+		}
+		if s, ok := n.dependentSchemas[name]; ok {
+			s.validate(x, path, errs)
+		}
+	}
+	for _, name := range names {
+		pv := x[name]
+		propPath := joinPath(path, name)
+		if n.propertyNames != nil && !n.propertyNames.valid(name) {
+			fail("propertyNames", "property name %q is not allowed", name)
+		}
+		matched := false
+		if s, ok := n.properties[name]; ok {
+			s.validate(pv, propPath, errs)
+			matched = true
+		}
+		for re, s := range n.patternProperties {
+			if re.MatchString(name) {
+				s.validate(pv, propPath, errs)
+				matched = true
+			}
+		}
+		if !matched && n.additional != nil {
+			if n.additional.always != nil && !*n.additional.always {
+				*errs = append(*errs, &ValidationError{Path: propPath, Keyword: "additionalProperties", Message: "additional property not allowed"})
+				continue
+			}
+			n.additional.validate(pv, propPath, errs)
+		}
+	}
+}
+
+var identRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// joinPath appends a property name to a JSON path ($.a or $["a b"])
+func joinPath(path, name string) string {
+	if identRe.MatchString(name) {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+func compactJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// toRat parses a schema keyword's number. Payload numbers go through parseDecimal
+// instead: big.Rat's cost grows with the exponent (1e999999 takes tens of ms).
+func toRat(v interface{}) (*big.Rat, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, false
+	}
+	return new(big.Rat).SetString(n.String())
+}
+
+// decimal is a JSON number as sign × digits × 10^exp, with digits free of leading
+// and trailing zeros ("" for zero). Parsing, comparing and classifying it takes time
+// linear in the number's text, whatever its exponent.
+type decimal struct {
+	neg    bool
+	digits string
+	exp    int
+}
+
+// bound is a numeric limit from the schema, with its text for error messages
+type bound struct {
+	decimal
+	text string
+}
+
+const (
+	// maxExponent clamps exponents, far beyond the range of any other number
+	maxExponent = 1 << 40
+	// maxRatDigits and maxRatExponent bound the payload numbers converted to big.Rat
+	// for multipleOf
+	maxRatDigits   = 100
+	maxRatExponent = 400
+)
+
+func parseDecimal(n json.Number) decimal {
+	s := string(n)
+	var d decimal
+	if strings.HasPrefix(s, "-") {
+		d.neg, s = true, s[1:]
+	}
+	exp := 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(strings.TrimPrefix(s[i+1:], "+"))
+		if errors.Is(err, strconv.ErrRange) {
+			e = maxExponent
+			if strings.HasPrefix(s[i+1:], "-") {
+				e = -maxExponent
+			}
+		}
+		exp, s = max(-maxExponent, min(e, maxExponent)), s[:i]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	digits := strings.TrimLeft(whole+frac, "0")
+	trimmed := strings.TrimRight(digits, "0")
+	if trimmed == "" {
+		return decimal{} // zero, whatever its sign
+	}
+	d.digits, d.exp = trimmed, exp-len(frac)+len(digits)-len(trimmed)
+	return d
+}
+
+func (d decimal) sign() int {
+	switch {
+	case d.digits == "":
+		return 0
+	case d.neg:
+		return -1
+	}
+	return 1
+}
+
+func (d decimal) isInt() bool {
+	return d.exp >= 0 || d.digits == ""
+}
+
+// cmp compares d and o by value
+func (d decimal) cmp(o decimal) int {
+	if ds, os := d.sign(), o.sign(); ds != os || ds == 0 {
+		return cmp.Compare(ds, os)
+	}
+	// magnitude: first by the position of the leading digit, then digit by digit
+	// (with no trailing zeros, a digit string that is a prefix of the other is smaller)
+	c := cmp.Compare(len(d.digits)+d.exp, len(o.digits)+o.exp)
+	if c == 0 {
+		c = strings.Compare(d.digits, o.digits)
+	}
+	if d.neg {
+		return -c
+	}
+	return c
+}
+
+// rat returns d exactly, unless its size would make big.Rat slow
+func (d decimal) rat() (*big.Rat, bool) {
+	if len(d.digits) > maxRatDigits || d.exp > maxRatExponent || d.exp < -maxRatExponent {
+		return nil, false
+	}
+	if d.digits == "" {
+		return new(big.Rat), true
+	}
+	s := d.digits + "e" + strconv.Itoa(d.exp)
+	if d.neg {
+		s = "-" + s
+	}
+	return new(big.Rat).SetString(s)
+}
+
+// ratString formats r as a decimal (0.5 rather than 1/2)
+func ratString(r *big.Rat) string {
+	if r.IsInt() {
+		return r.RatString()
+	}
+	s := strings.TrimRight(r.FloatString(12), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func toStrings(raw interface{}) ([]string, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("must be an array of strings")
+	}
+	out := make([]string, len(list))
+	for i, x := range list {
+		s, ok := x.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be an array of strings")
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+// jsonEqual compares decoded JSON values; numbers compare by value (1 == 1.0)
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		return ok && parseDecimal(x) == parseDecimal(y)
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, xv := range x {
+			yv, ok := y[k]
+			if !ok || !jsonEqual(xv, yv) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if parseDecimal(x).isInt() {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func jsonTypeMatches(t string, v interface{}) bool {
+	got := jsonTypeOf(v)
+	if t == "number" && got == "integer" {
+		return true
+	}
+	return t == got
+}
+
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+func pointerOrRoot(ptr string) string {
+	if ptr == "" {
+		return "#"
+	}
+	return "#" + ptr
+}
+
+// lookupPointer resolves a JSON pointer (RFC 6901) within doc
+func lookupPointer(doc interface{}, ptr string) (interface{}, error) {
+	if ptr == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", ptr)
+	}
+	cur := doc
+	for _, tok := range strings.Split(ptr[1:], "/") {
+		tok = strings.NewReplacer("~1", "/", "~0", "~").Replace(tok)
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			next, ok := v[tok]
+			if !ok {
+				return nil, fmt.Errorf("pointer %q not found", ptr)
+			}
+			cur = next
+		case []interface{}:
+			i, err := strconv.Atoi(tok)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("pointer %q not found", ptr)
+			}
+			cur = v[i]
+		default:
+			return nil, fmt.Errorf("pointer %q not found", ptr)
+		}
+	}
+	return cur, nil
+}
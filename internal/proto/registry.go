@@ -0,0 +1,500 @@
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ErrSchemaExists is returned when registering a schema ID that is already taken
+var ErrSchemaExists = errors.New("schema already registered")
+
+// Validator checks that a payload matches a schema
+type Validator interface {
+	Validate(payload []byte) error
+}
+
+// ValidatorFunc adapts a plain function to a Validator
+type ValidatorFunc func(payload []byte) error
+
+// Validate calls f(payload)
+func (f ValidatorFunc) Validate(payload []byte) error {
+	return f(payload)
+}
+
+// SchemaRegistry maps schema IDs to validators. Schemas can be added at runtime
+// from Go structs, JSON Schema documents or protobuf descriptors. Safe for concurrent use.
+//
+// IDs may carry a version ("sensor.Temperature@2"); an unversioned ID registers
+// version 1 and looks up the latest version. Registering a new version runs the
+// subject's compatibility check against its neighbouring versions.
+type SchemaRegistry struct {
+	mu       sync.RWMutex
+	subjects map[string]*schemaSubject
+	types    map[reflect.Type]string // struct type -> versioned ID, for SchemaIDFor
+	compat   Compatibility           // default for subjects without their own mode
+}
+
+type schemaSubject struct {
+	versions  map[int]Validator
+	descs     map[int]protoreflect.MessageDescriptor // protobuf types attached with AttachDescriptor
+	strict    map[int]Validator                      // strict-mode validators from RegisterStrict
+	latest    int
+	compat    Compatibility
+	hasCompat bool
+}
+
+// NewSchemaRegistry returns an empty registry
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{subjects: make(map[string]*schemaSubject), types: make(map[reflect.Type]string)}
+}
+
+// NewDefaultRegistry returns a registry preloaded with the built-in schemas
+func NewDefaultRegistry() *SchemaRegistry {
+	r := NewSchemaRegistry()
+	registerBuiltins(r)
+	return r
+}
+
+// DefaultRegistry backs ValidatePayload and KnownSchemas
+var DefaultRegistry = NewDefaultRegistry()
+
+// SetCompatibility sets the compatibility mode for a schema name ("sensor.Temperature").
+// An empty name sets the default for all names without their own mode (initially CompatBackward).
+func (r *SchemaRegistry) SetCompatibility(name string, c Compatibility) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name == "" {
+		r.compat = c
+		return
+	}
+	name, _ = ParseSchemaID(name)
+	sub := r.subject(name)
+	sub.compat, sub.hasCompat = c, true
+}
+
+// Compatibility returns the mode applied to new versions of name
+func (r *SchemaRegistry) Compatibility(name string) Compatibility {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, _ = ParseSchemaID(name)
+	if sub, ok := r.subjects[name]; ok && sub.hasCompat {
+		return sub.compat
+	}
+	return r.compat
+}
+
+// subject returns (creating if needed) the subject for name. Caller holds r.mu.
+func (r *SchemaRegistry) subject(name string) *schemaSubject {
+	sub, ok := r.subjects[name]
+	if !ok {
+		sub = &schemaSubject{versions: make(map[int]Validator)}
+		r.subjects[name] = sub
+	}
+	return sub
+}
+
+// Register adds a validator under id. Unversioned IDs register version 1.
+// Returns an *IncompatibleError if the version breaks the subject's compatibility mode.
+func (r *SchemaRegistry) Register(id string, v Validator) error {
+	name, version := ParseSchemaID(id)
+	if name == "" {
+		return errors.New("schema id required")
+	}
+	if v == nil {
+		return fmt.Errorf("schema %s: nil validator", id)
+	}
+	if version == 0 {
+		version = 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub := r.subject(name)
+	if _, ok := sub.versions[version]; ok {
+		return fmt.Errorf("%w: %s", ErrSchemaExists, FormatSchemaID(name, version))
+	}
+	mode := r.compat
+	if sub.hasCompat {
+		mode = sub.compat
+	}
+	prev, next := 0, 0
+	for ver := range sub.versions {
+		if ver < version && ver > prev {
+			prev = ver
+		}
+		if ver > version && (next == 0 || ver < next) {
+			next = ver
+		}
+	}
+	id = FormatSchemaID(name, version)
+	for _, pair := range [][2]int{{prev, version}, {version, next}} {
+		if pair[0] == 0 || pair[1] == 0 {
+			continue
+		}
+		older, newer := sub.versions[pair[0]], sub.versions[pair[1]]
+		if pair[0] == version {
+			older = v
+		} else {
+			newer = v
+		}
+		problems, err := checkCompatibility(mode, older, newer)
+		if err != nil {
+			return fmt.Errorf("schema %s: %w", id, err)
+		}
+		if len(problems) > 0 {
+			return &IncompatibleError{
+				ID:       FormatSchemaID(name, pair[1]),
+				Against:  FormatSchemaID(name, pair[0]),
+				Mode:     mode,
+				Problems: problems,
+			}
+		}
+	}
+	sub.versions[version] = v
+	if version > sub.latest {
+		sub.latest = version
+	}
+	if sv, ok := v.(structValidator); ok {
+		if cur, ok := r.types[sv.t]; !ok || olderVersion(cur, id) {
+			r.types[sv.t] = id
+		}
+	}
+	return nil
+}
+
+// olderVersion reports whether a is an older version of the same name as b
+func olderVersion(a, b string) bool {
+	an, av := ParseSchemaID(a)
+	bn, bv := ParseSchemaID(b)
+	return an == bn && av < bv
+}
+
+// SchemaIDFor returns the versioned ID a Go struct type was registered under
+// (the latest version if registered more than once)
+func (r *SchemaRegistry) SchemaIDFor(t reflect.Type) (string, bool) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.types[t]
+	return id, ok
+}
+
+// RegisterStruct registers a Go struct type: payloads are valid if they decode into it.
+// sample is a value or pointer of the struct type (e.g. Temperature{}).
+func (r *SchemaRegistry) RegisterStruct(id string, sample interface{}) error {
+	t := reflect.TypeOf(sample)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("schema %s: sample must be a struct, got %T", id, sample)
+	}
+	return r.Register(id, structValidator{t: t})
+}
+
+// RegisterJSONSchema registers a JSON Schema document under id
+func (r *SchemaRegistry) RegisterJSONSchema(id string, doc []byte) error {
+	s, err := CompileJSONSchema(doc)
+	if err != nil {
+		return fmt.Errorf("schema %s: %w", id, err)
+	}
+	return r.Register(id, s)
+}
+
+// RegisterDescriptor registers a protobuf message descriptor under id.
+// Payloads are the protojson form of the message.
+func (r *SchemaRegistry) RegisterDescriptor(id string, md protoreflect.MessageDescriptor) error {
+	if md == nil {
+		return fmt.Errorf("schema %s: nil descriptor", id)
+	}
+	return r.Register(id, descriptorValidator{md: md})
+}
+
+// RegisterFileDescriptorSet registers every message in a serialized
+// FileDescriptorSet (protoc --descriptor_set_out) under its full name.
+func (r *SchemaRegistry) RegisterFileDescriptorSet(data []byte) ([]string, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := gproto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("descriptor set: %w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set: %w", err)
+	}
+	var ids []string
+	var regErr error
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		msgs := fd.Messages()
+		for i := 0; i < msgs.Len(); i++ {
+			md := msgs.Get(i)
+			if md.IsMapEntry() {
+				continue
+			}
+			id := string(md.FullName())
+			if regErr = r.RegisterDescriptor(id, md); regErr != nil {
+				return false
+			}
+			ids = append(ids, id)
+		}
+		return true
+	})
+	return ids, regErr
+}
+
+// Unregister removes id. An unversioned ID removes every version.
+func (r *SchemaRegistry) Unregister(id string) {
+	name, version := ParseSchemaID(id)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub, ok := r.subjects[name]
+	if !ok {
+		return
+	}
+	for t, tid := range r.types {
+		if tn, tv := ParseSchemaID(tid); tn == name && (version == 0 || tv == version) {
+			delete(r.types, t)
+		}
+	}
+	if version == 0 {
+		delete(r.subjects, name)
+		return
+	}
+	delete(sub.versions, version)
+	delete(sub.descs, version)
+	delete(sub.strict, version)
+	sub.latest = 0
+	for ver := range sub.versions {
+		if ver > sub.latest {
+			sub.latest = ver
+		}
+	}
+}
+
+// Resolve returns the versioned ID that id refers to ("sensor.Temperature" -> "sensor.Temperature@1")
+func (r *SchemaRegistry) Resolve(id string) (string, bool) {
+	name, version := ParseSchemaID(id)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subjects[name]
+	if !ok {
+		return "", false
+	}
+	if version == 0 {
+		version = sub.latest
+	}
+	if _, ok := sub.versions[version]; !ok {
+		return "", false
+	}
+	return FormatSchemaID(name, version), true
+}
+
+// Lookup returns the validator registered under id (latest version if unversioned)
+func (r *SchemaRegistry) Lookup(id string) (Validator, bool) {
+	name, version := ParseSchemaID(id)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subjects[name]
+	if !ok {
+		return nil, false
+	}
+	if version == 0 {
+		version = sub.latest
+	}
+	v, ok := sub.versions[version]
+	return v, ok
+}
+
+// Has reports whether id is registered
+func (r *SchemaRegistry) Has(id string) bool {
+	_, ok := r.Lookup(id)
+	return ok
+}
+
+// Validate checks payload against the schema registered under id
+func (r *SchemaRegistry) Validate(id string, payload []byte) error {
+	v, ok := r.Lookup(id)
+	if !ok {
+		return fmt.Errorf("unknown schema: %s", id)
+	}
+	return v.Validate(payload)
+}
+
+// CanRead reports whether a consumer of readerID can accept payloads published as writerID.
+// Identical IDs always can; different versions of one name are compared structurally.
+func (r *SchemaRegistry) CanRead(readerID, writerID string) error {
+	rid, ok := r.Resolve(readerID)
+	if !ok {
+		return fmt.Errorf("unknown schema: %s", readerID)
+	}
+	wid, ok := r.Resolve(writerID)
+	if !ok {
+		return fmt.Errorf("unknown schema: %s", writerID)
+	}
+	if rid == wid {
+		return nil
+	}
+	rname, _ := ParseSchemaID(rid)
+	wname, _ := ParseSchemaID(wid)
+	if rname != wname {
+		return fmt.Errorf("schema %s cannot read %s", rid, wid)
+	}
+	rv, _ := r.Lookup(rid)
+	wv, _ := r.Lookup(wid)
+	rd, ok1 := rv.(Describer)
+	wd, ok2 := wv.(Describer)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("schema %s cannot read %s: validators do not describe their shape", rid, wid)
+	}
+	if problems := readProblems(rd.Shape(), wd.Shape()); len(problems) > 0 {
+		return fmt.Errorf("%w: %s cannot read %s: %s", ErrIncompatible, rid, wid, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// IDs returns all registered schema names (without versions), sorted
+func (r *SchemaRegistry) IDs() []string {
+	r.mu.RLock()
+	ids := make([]string, 0, len(r.subjects))
+	for name, sub := range r.subjects {
+		if len(sub.versions) > 0 {
+			ids = append(ids, name)
+		}
+	}
+	r.mu.RUnlock()
+	sort.Strings(ids)
+	return ids
+}
+
+// Versions returns the registered versions of name, ascending
+func (r *SchemaRegistry) Versions(name string) []int {
+	name, _ = ParseSchemaID(name)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subjects[name]
+	if !ok {
+		return nil
+	}
+	vers := make([]int, 0, len(sub.versions))
+	for ver := range sub.versions {
+		vers = append(vers, ver)
+	}
+	sort.Ints(vers)
+	return vers
+}
+
+// LoadDir registers every schema file in dir:
+//   - *.json: JSON Schema document, ID from "$id" or the file name without extension
+//     (versioned IDs such as "sensor.Temperature@2" are allowed). A "$id" that is a
+//     URI (e.g. "https://example.com/pressure.json") is not a schema ID; the file
+//     name is used instead.
+//   - *.binpb, *.pb, *.desc: FileDescriptorSet, one ID per message full name
+//
+// Other files are ignored.
+func (r *SchemaRegistry) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		switch ext {
+		case ".json":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			id := schemaIDFromDoc(data)
+			if id == "" {
+				id = strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+			}
+			if err := r.RegisterJSONSchema(id, data); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		case ".binpb", ".pb", ".desc":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if _, err := r.RegisterFileDescriptorSet(data); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// schemaIDFromDoc returns the "$id" of a JSON Schema document if it is a schema ID
+// such as "sensor.Pressure@2", not a URI or URI reference
+func schemaIDFromDoc(doc []byte) string {
+	var head struct {
+		ID string `json:"$id"`
+	}
+	if json.Unmarshal(doc, &head) != nil || strings.ContainsAny(head.ID, ":/#?") {
+		return ""
+	}
+	return head.ID
+}
+
+// structValidator accepts payloads that decode into a Go struct type
+type structValidator struct {
+	t               reflect.Type
+	check           func(v interface{}) error // optional extra check on the decoded pointer
+	disallowUnknown bool                      // strict mode
+}
+
+func (s structValidator) Validate(payload []byte) error {
+	var v interface{}
+	var err error
+	if s.disallowUnknown {
+		v, err = decodeStrict(s.t, payload)
+	} else {
+		v = reflect.New(s.t).Interface()
+		err = json.Unmarshal(payload, v)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", typeName(s.t), err)
+	}
+	if s.check != nil {
+		return s.check(v)
+	}
+	return nil
+}
+
+func typeName(t reflect.Type) string {
+	if t.Name() != "" {
+		return t.Name()
+	}
+	return t.String()
+}
+
+// descriptorValidator accepts payloads that decode into a protobuf message
+type descriptorValidator struct {
+	md protoreflect.MessageDescriptor
+}
+
+func (d descriptorValidator) Validate(payload []byte) error {
+	msg := dynamicpb.NewMessage(d.md)
+	if err := protojson.Unmarshal(payload, msg); err != nil {
+		return fmt.Errorf("invalid %s: %w", d.md.Name(), err)
+	}
+	return nil
+}
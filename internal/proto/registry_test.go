@@ -0,0 +1,36 @@
+package proto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDirSchemaIDs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"sensor.Pressure.json": `{"$id": "https://example.com/schemas/pressure.json", "type": "object", "required": ["hpa"]}`,
+		"wind.json":            `{"$id": "sensor.Wind@2", "type": "object"}`,
+		"sensor.Rain.json":     `{"type": "object"}`,
+	}
+	for name, doc := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(doc), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewSchemaRegistry()
+	if err := r.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"sensor.Pressure", "sensor.Wind@2", "sensor.Rain"} {
+		if !r.Has(id) {
+			t.Errorf("schema %q not registered", id)
+		}
+	}
+	if r.Has("https://example.com/schemas/pressure.json") {
+		t.Error("URI $id registered as a schema ID")
+	}
+	if err := r.Validate("sensor.Pressure", []byte(`{}`)); err == nil {
+		t.Error("sensor.Pressure accepted a payload without hpa")
+	}
+}
@@ -1,8 +1,8 @@
 package proto
 
 import (
-	"encoding/json"
 	"fmt"
+	"reflect"
 )
 
 // Schema IDs for typed topics
@@ -10,6 +10,7 @@ const (
 	SchemaTemperature = "sensor.Temperature"
 	SchemaHumidity    = "sensor.Humidity"
 	SchemaCommand     = "control.Command"
+	SchemaPresence    = "relay.Presence"
 )
 
 // Temperature sensor reading
@@ -32,36 +33,39 @@ type Command struct {
 	Params map[string]string `json:"params"`
 }
 
-// ValidatePayload checks that payload matches the expected schema
-func ValidatePayload(schemaID string, payload []byte) error {
-	switch schemaID {
-	case SchemaTemperature:
-		var t Temperature
-		if err := json.Unmarshal(payload, &t); err != nil {
-			return fmt.Errorf("invalid Temperature: %w", err)
-		}
-		return nil
-	case SchemaHumidity:
-		var h Humidity
-		if err := json.Unmarshal(payload, &h); err != nil {
-			return fmt.Errorf("invalid Humidity: %w", err)
-		}
-		return nil
-	case SchemaCommand:
-		var c Command
-		if err := json.Unmarshal(payload, &c); err != nil {
-			return fmt.Errorf("invalid Command: %w", err)
-		}
-		if c.Action == "" {
-			return fmt.Errorf("Command.action required")
-		}
-		return nil
-	default:
-		return fmt.Errorf("unknown schema: %s", schemaID)
+// Presence is published by the relay on $presence/<node_id> when a node connects or disconnects
+type Presence struct {
+	NodeID      string `json:"node_id"`
+	Online      bool   `json:"online"`
+	TimestampMs int64  `json:"timestamp_ms"`
+}
+
+// registerBuiltins adds the built-in schemas to r
+func registerBuiltins(r *SchemaRegistry) {
+	_ = r.RegisterStruct(SchemaTemperature, Temperature{})
+	_ = r.RegisterStruct(SchemaHumidity, Humidity{})
+	_ = r.Register(SchemaCommand, structValidator{t: reflect.TypeOf(Command{}), check: checkCommand})
+	_ = r.RegisterStruct(SchemaPresence, Presence{})
+	_ = r.AttachDescriptor(SchemaTemperature, builtinDescriptor("Temperature"))
+	_ = r.AttachDescriptor(SchemaHumidity, builtinDescriptor("Humidity"))
+	_ = r.AttachDescriptor(SchemaCommand, builtinDescriptor("Command"))
+	registerStrictBuiltins(r)
+}
+
+func checkCommand(v interface{}) error {
+	c := v.(*Command)
+	if c.Action == "" {
+		return fmt.Errorf("Command.action required")
 	}
+	return nil
+}
+
+// ValidatePayload checks that payload matches the expected schema in DefaultRegistry
+func ValidatePayload(schemaID string, payload []byte) error {
+	return DefaultRegistry.Validate(schemaID, payload)
 }
 
-// KnownSchemas returns all registered schema IDs
+// KnownSchemas returns all schema IDs registered in DefaultRegistry
 func KnownSchemas() []string {
-	return []string{SchemaTemperature, SchemaHumidity, SchemaCommand}
+	return DefaultRegistry.IDs()
 }
@@ -0,0 +1,68 @@
+package proto
+
+import (
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// schemaFileDesc mirrors proto/schema.proto so the built-in schemas can be sent
+// protobuf-encoded without generated code.
+var schemaFileDesc = func() protoreflect.FileDescriptor {
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   gproto.String(name),
+			Number: gproto.Int32(num),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+	}
+	reading := func(name, value string) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{
+			Name: gproto.String(name),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field(value, 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				field("timestamp_ms", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+				field("sensor_id", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			},
+		}
+	}
+	params := field("params", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	params.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	params.TypeName = gproto.String(".qumbed.schema.Command.ParamsEntry")
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    gproto.String("schema.proto"),
+		Package: gproto.String("qumbed.schema"),
+		Syntax:  gproto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			reading("Temperature", "celsius"),
+			reading("Humidity", "percent"),
+			{
+				Name: gproto.String("Command"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("action", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					params,
+				},
+				NestedType: []*descriptorpb.DescriptorProto{{
+					Name: gproto.String("ParamsEntry"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+						field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: gproto.Bool(true)},
+				}},
+			},
+		},
+	}
+	f, err := protodesc.NewFile(fd, nil)
+	if err != nil {
+		panic("proto: built-in schema descriptor: " + err.Error())
+	}
+	return f
+}()
+
+// builtinDescriptor returns the message type for a built-in schema (e.g. "Temperature")
+func builtinDescriptor(name string) protoreflect.MessageDescriptor {
+	return schemaFileDesc.Messages().ByName(protoreflect.Name(name))
+}
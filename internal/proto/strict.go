@@ -0,0 +1,144 @@
+package proto
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// strictSchemas holds the strict JSON Schemas for the built-in schema IDs
+//
+//go:embed schemas/*.json
+var strictSchemas embed.FS
+
+// DefaultCommandActions are the control.Command actions accepted in strict mode
+var DefaultCommandActions = []string{"start", "stop", "calibrate"}
+
+// RegisterStrict sets the validator used by ValidateStrict for id.
+// Without one, strict mode rejects unknown fields for struct schemas and
+// otherwise falls back to the normal validator.
+func (r *SchemaRegistry) RegisterStrict(id string, v Validator) error {
+	if v == nil {
+		return fmt.Errorf("schema %s: nil validator", id)
+	}
+	name, version := ParseSchemaID(id)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub, ok := r.subjects[name]
+	if !ok {
+		return fmt.Errorf("unknown schema: %s", id)
+	}
+	if version == 0 {
+		version = sub.latest
+	}
+	if _, ok := sub.versions[version]; !ok {
+		return fmt.Errorf("unknown schema: %s", id)
+	}
+	if sub.strict == nil {
+		sub.strict = make(map[int]Validator)
+	}
+	sub.strict[version] = v
+	return nil
+}
+
+// strictValidator returns the strict validator for id
+func (r *SchemaRegistry) strictValidator(id string) (Validator, bool) {
+	name, version := ParseSchemaID(id)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subjects[name]
+	if !ok {
+		return nil, false
+	}
+	if version == 0 {
+		version = sub.latest
+	}
+	if v, ok := sub.strict[version]; ok {
+		return v, true
+	}
+	v, ok := sub.versions[version]
+	if !ok {
+		return nil, false
+	}
+	if sv, ok := v.(structValidator); ok {
+		sv.disallowUnknown = true
+		return sv, true
+	}
+	return v, true
+}
+
+// ValidateStrict is ValidateEncoded using the schema's strict validator: unknown
+// fields, missing required fields and out-of-range values are rejected.
+func (r *SchemaRegistry) ValidateStrict(id string, enc Encoding, payload []byte) error {
+	v, ok := r.strictValidator(id)
+	if !ok {
+		return fmt.Errorf("unknown schema: %s", id)
+	}
+	if enc.orJSON() != EncodingJSON {
+		js, err := r.Transcode(id, enc, EncodingJSON, payload)
+		if err != nil {
+			return err
+		}
+		payload = js
+	}
+	return v.Validate(payload)
+}
+
+// StrictCommand returns a strict control.Command validator that only accepts the given actions
+func StrictCommand(actions ...string) Validator {
+	doc := mustCompileEmbedded(SchemaCommand)
+	allowed := make(map[string]struct{}, len(actions))
+	for _, a := range actions {
+		allowed[a] = struct{}{}
+	}
+	return ValidatorFunc(func(payload []byte) error {
+		if err := doc.Validate(payload); err != nil {
+			return err
+		}
+		var c Command
+		if err := json.Unmarshal(payload, &c); err != nil {
+			return fmt.Errorf("invalid Command: %w", err)
+		}
+		if _, ok := allowed[c.Action]; !ok {
+			return ValidationErrors{{
+				Path:    "$.action",
+				Keyword: "enum",
+				Message: fmt.Sprintf("action %q not allowed (want one of %s)", c.Action, strings.Join(actions, ", ")),
+			}}
+		}
+		return nil
+	})
+}
+
+// registerStrictBuiltins adds the strict validators for the built-in schemas
+func registerStrictBuiltins(r *SchemaRegistry) {
+	_ = r.RegisterStrict(SchemaTemperature, mustCompileEmbedded(SchemaTemperature))
+	_ = r.RegisterStrict(SchemaHumidity, mustCompileEmbedded(SchemaHumidity))
+	_ = r.RegisterStrict(SchemaCommand, StrictCommand(DefaultCommandActions...))
+}
+
+func mustCompileEmbedded(id string) *JSONSchema {
+	doc, err := strictSchemas.ReadFile("schemas/" + id + ".json")
+	if err != nil {
+		panic("proto: missing strict schema for " + id)
+	}
+	s, err := CompileJSONSchema(doc)
+	if err != nil {
+		panic("proto: strict schema " + id + ": " + err.Error())
+	}
+	return s
+}
+
+// decodeStrict decodes payload into a new value of t, rejecting unknown fields
+func decodeStrict(t reflect.Type, payload []byte) (interface{}, error) {
+	v := reflect.New(t).Interface()
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
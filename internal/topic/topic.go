@@ -0,0 +1,129 @@
+// Package topic implements MQTT-style hierarchical topics: levels separated by "/",
+// "+" matching exactly one level and a trailing "#" matching any number of levels
+// (including none, so "sensors/#" matches "sensors").
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Separator splits a topic into levels
+	Separator = "/"
+	// SingleLevel matches exactly one level
+	SingleLevel = "+"
+	// MultiLevel matches the remaining levels; only valid as the last level
+	MultiLevel = "#"
+)
+
+// ErrEmpty is returned for an empty topic or filter
+var ErrEmpty = errors.New("empty topic")
+
+// ValidateName checks a topic used for Publish: wildcards are not allowed
+func ValidateName(name string) error {
+	if name == "" {
+		return ErrEmpty
+	}
+	if strings.ContainsAny(name, SingleLevel+MultiLevel) {
+		return fmt.Errorf("topic %q: wildcards are only allowed in subscriptions", name)
+	}
+	return nil
+}
+
+// ValidateFilter checks a subscription filter: "+" and "#" must fill a whole level
+// and "#" must be the last level
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return ErrEmpty
+	}
+	levels := strings.Split(filter, Separator)
+	for i, l := range levels {
+		switch {
+		case l == MultiLevel:
+			if i != len(levels)-1 {
+				return fmt.Errorf("filter %q: %q must be the last level", filter, MultiLevel)
+			}
+		case l == SingleLevel:
+		case strings.ContainsAny(l, SingleLevel+MultiLevel):
+			return fmt.Errorf("filter %q: wildcard must occupy a whole level", filter)
+		}
+	}
+	return nil
+}
+
+// IsWildcard reports whether filter contains "+" or "#" levels
+func IsWildcard(filter string) bool {
+	return strings.ContainsAny(filter, SingleLevel+MultiLevel)
+}
+
+// Match reports whether topic name matches filter. As in MQTT, topics starting with
+// "$" are reserved and not matched by a leading wildcard.
+func Match(filter, name string) bool {
+	if filter == name {
+		return true
+	}
+	if !IsWildcard(filter) {
+		return false
+	}
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, SingleLevel) || strings.HasPrefix(filter, MultiLevel)) {
+		return false
+	}
+	fl := strings.Split(filter, Separator)
+	nl := strings.Split(name, Separator)
+	for i, f := range fl {
+		if f == MultiLevel {
+			return true
+		}
+		if i >= len(nl) {
+			return false
+		}
+		if f != SingleLevel && f != nl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(nl)
+}
+
+// Covers reports whether every topic matched by filter is also matched by pattern
+// (e.g. "sensors/#" covers "sensors/+/temp", but "sensors/+" does not cover "sensors/#")
+func Covers(pattern, filter string) bool {
+	if pattern == filter {
+		return true
+	}
+	if strings.HasPrefix(filter, "$") && (strings.HasPrefix(pattern, SingleLevel) || strings.HasPrefix(pattern, MultiLevel)) {
+		return false
+	}
+	pl := strings.Split(pattern, Separator)
+	fl := strings.Split(filter, Separator)
+	for i, p := range pl {
+		if p == MultiLevel {
+			return true
+		}
+		if i >= len(fl) {
+			return false
+		}
+		switch f := fl[i]; {
+		case f == MultiLevel:
+			return false // filter reaches deeper than pattern allows
+		case p == SingleLevel:
+		case p != f: // includes a "+" filter level under a literal pattern level
+			return false
+		}
+	}
+	return len(pl) == len(fl)
+}
+
+// ValidateGroup checks a shared subscription group name: non-empty, no "/" or wildcards
+func ValidateGroup(group string) error {
+	if !IsLevel(group) {
+		return fmt.Errorf("invalid group name %q", group)
+	}
+	return nil
+}
+
+// IsLevel reports whether s can be used as a single topic level: non-empty, no "/" or wildcards
+func IsLevel(s string) bool {
+	return s != "" && !strings.ContainsAny(s, Separator+SingleLevel+MultiLevel)
+}
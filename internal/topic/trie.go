@@ -0,0 +1,218 @@
+package topic
+
+import (
+	"strings"
+	"sync"
+)
+
+// Trie indexes subscriptions by filter so a published topic finds its subscribers
+// in time proportional to its depth rather than the number of filters.
+// Each filter holds entries keyed by K (e.g. a connection); it is safe for concurrent use.
+type Trie[K comparable, V any] struct {
+	mu   sync.RWMutex
+	root *trieNode[K, V]
+}
+
+type trieNode[K comparable, V any] struct {
+	children map[string]*trieNode[K, V]
+	filter   string // set on nodes that end a filter
+	entries  map[K]V
+}
+
+// NewTrie returns an empty trie
+func NewTrie[K comparable, V any]() *Trie[K, V] {
+	return &Trie[K, V]{root: &trieNode[K, V]{}}
+}
+
+// Add stores v for key under filter, replacing an earlier value for the same key
+func (t *Trie[K, V]) Add(filter string, key K, v V) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.root
+	for _, l := range strings.Split(filter, Separator) {
+		if n.children == nil {
+			n.children = make(map[string]*trieNode[K, V])
+		}
+		c, ok := n.children[l]
+		if !ok {
+			c = &trieNode[K, V]{}
+			n.children[l] = c
+		}
+		n = c
+	}
+	if n.entries == nil {
+		n.entries = make(map[K]V)
+	}
+	n.filter = filter
+	n.entries[key] = v
+}
+
+// Remove deletes key from filter; false if it was not there
+func (t *Trie[K, V]) Remove(filter string, key K) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.root.remove(strings.Split(filter, Separator), key)
+}
+
+func (n *trieNode[K, V]) remove(levels []string, key K) bool {
+	if len(levels) == 0 {
+		if _, ok := n.entries[key]; !ok {
+			return false
+		}
+		delete(n.entries, key)
+		return true
+	}
+	c, ok := n.children[levels[0]]
+	if !ok {
+		return false
+	}
+	removed := c.remove(levels[1:], key)
+	if c.empty() {
+		delete(n.children, levels[0])
+	}
+	return removed
+}
+
+// RemoveKey deletes key from every filter (e.g. when a connection closes)
+func (t *Trie[K, V]) RemoveKey(key K) {
+	t.RemoveWhere(func(_ string, k K) bool { return k == key })
+}
+
+// RemoveWhere deletes the entries for which fn(filter, key) is true, under every filter
+func (t *Trie[K, V]) RemoveWhere(fn func(filter string, key K) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.root.removeWhere(fn)
+}
+
+func (n *trieNode[K, V]) removeWhere(fn func(string, K) bool) {
+	for k := range n.entries {
+		if fn(n.filter, k) {
+			delete(n.entries, k)
+		}
+	}
+	for l, c := range n.children {
+		c.removeWhere(fn)
+		if c.empty() {
+			delete(n.children, l)
+		}
+	}
+}
+
+func (n *trieNode[K, V]) empty() bool {
+	return len(n.entries) == 0 && len(n.children) == 0
+}
+
+// Get returns the value stored for key under filter
+func (t *Trie[K, V]) Get(filter string, key K) (V, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := t.root
+	for _, l := range strings.Split(filter, Separator) {
+		if n = n.children[l]; n == nil {
+			var zero V
+			return zero, false
+		}
+	}
+	v, ok := n.entries[key]
+	return v, ok
+}
+
+// Keys returns the keys stored under filter
+func (t *Trie[K, V]) Keys(filter string) []K {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := t.root
+	for _, l := range strings.Split(filter, Separator) {
+		if n = n.children[l]; n == nil {
+			return nil
+		}
+	}
+	out := make([]K, 0, len(n.entries))
+	for k := range n.entries {
+		out = append(out, k)
+	}
+	return out
+}
+
+// Match calls fn for every entry whose filter matches topic name. A key subscribed
+// with several matching filters is reported once per filter. fn must not modify the trie.
+func (t *Trie[K, V]) Match(name string, fn func(filter string, key K, v V)) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	levels := strings.Split(name, Separator)
+	t.root.match(levels, strings.HasPrefix(name, "$"), fn)
+}
+
+func (n *trieNode[K, V]) match(levels []string, reserved bool, fn func(string, K, V)) {
+	// "#" matches the rest, including the parent level itself ("a/#" matches "a")
+	if c, ok := n.children[MultiLevel]; ok && !reserved {
+		c.emit(fn)
+	}
+	if len(levels) == 0 {
+		n.emit(fn)
+		return
+	}
+	if c, ok := n.children[levels[0]]; ok {
+		c.match(levels[1:], false, fn)
+	}
+	if c, ok := n.children[SingleLevel]; ok && !reserved {
+		c.match(levels[1:], false, fn)
+	}
+}
+
+func (n *trieNode[K, V]) emit(fn func(string, K, V)) {
+	for k, v := range n.entries {
+		fn(n.filter, k, v)
+	}
+}
+
+// Filters returns the filters key is subscribed to
+func (t *Trie[K, V]) Filters(key K) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var out []string
+	var walk func(*trieNode[K, V])
+	walk = func(n *trieNode[K, V]) {
+		if _, ok := n.entries[key]; ok {
+			out = append(out, n.filter)
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(t.root)
+	return out
+}
+
+// Each calls fn for every entry; fn must not modify the trie
+func (t *Trie[K, V]) Each(fn func(filter string, key K, v V)) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var walk func(*trieNode[K, V])
+	walk = func(n *trieNode[K, V]) {
+		n.emit(fn)
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(t.root)
+}
+
+// Counts returns the number of entries under each filter
+func (t *Trie[K, V]) Counts() map[string]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make(map[string]int)
+	var walk func(*trieNode[K, V])
+	walk = func(n *trieNode[K, V]) {
+		if len(n.entries) > 0 {
+			out[n.filter] = len(n.entries)
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(t.root)
+	return out
+}
@@ -0,0 +1,237 @@
+// Package trace propagates W3C trace context (traceparent) through publish and
+// delivery and records spans for a pluggable Exporter. Without an exporter nothing
+// is recorded, but an incoming trace context is still passed on.
+package trace
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// FlagSampled is the traceparent flag asking for the trace to be recorded
+const FlagSampled = 0x01
+
+// SpanContext is the part of a span that crosses process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// IsValid reports whether sc has a non-zero trace and span ID
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Sampled reports whether the sampled flag is set
+func (sc SpanContext) Sampled() bool { return sc.Flags&FlagSampled != 0 }
+
+// Traceparent formats sc as a W3C traceparent header value; empty if sc is not valid
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+var errTraceparent = errors.New("invalid traceparent")
+
+// ParseTraceparent parses a W3C traceparent header value
+// ("00-<32 hex trace ID>-<16 hex span ID>-<2 hex flags>")
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	// later versions may append fields; version 00 is exactly 55 characters
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || (len(s) > 55 && (s[:2] == "00" || s[55] != '-')) {
+		return sc, errTraceparent
+	}
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(s[0:2])); err != nil || version[0] == 0xff {
+		return sc, errTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, errTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, errTraceparent
+	}
+	if _, err := hex.Decode(flags[:], []byte(s[53:55])); err != nil {
+		return sc, errTraceparent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, errTraceparent
+	}
+	return sc, nil
+}
+
+type ctxKey struct{}
+
+// ContextWithSpanContext returns ctx carrying sc as the parent of spans started from it
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, ctxKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx; zero if none
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(ctxKey{}).(SpanContext)
+	return sc
+}
+
+// SpanKind is the role of a span, as in OpenTelemetry
+type SpanKind int
+
+const (
+	KindInternal SpanKind = iota
+	KindProducer          // publishing a message
+	KindConsumer          // receiving or processing a message
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case KindProducer:
+		return "producer"
+	case KindConsumer:
+		return "consumer"
+	}
+	return "internal"
+}
+
+// Span is a timed operation. Spans returned by Tracer.Start are exported when End
+// is called; a nil *Span is valid and does nothing.
+type Span struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID // zero for a root span
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]any
+	Err        string // set by SetError; empty if the operation succeeded
+
+	exporter Exporter
+}
+
+// SetAttribute records an attribute on the span
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]any)
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed with err; a nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Err = err.Error()
+}
+
+// End finishes the span and hands it to the exporter
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.EndTime = time.Now()
+	s.exporter.ExportSpan(s)
+}
+
+// Exporter receives finished spans. ExportSpan is called on the traced goroutine
+// and must not block; it owns the span from then on.
+type Exporter interface {
+	ExportSpan(s *Span)
+}
+
+// ExporterFunc adapts a function to an Exporter
+type ExporterFunc func(s *Span)
+
+func (f ExporterFunc) ExportSpan(s *Span) { f(s) }
+
+// LogExporter writes each span to l (slog.Default if nil)
+func LogExporter(l *slog.Logger) Exporter {
+	if l == nil {
+		l = slog.Default()
+	}
+	return ExporterFunc(func(s *Span) {
+		args := []any{
+			"trace_id", s.Context.TraceID,
+			"span_id", s.Context.SpanID,
+			"kind", s.Kind,
+			"duration", s.EndTime.Sub(s.StartTime),
+		}
+		if s.Parent != (SpanID{}) {
+			args = append(args, "parent_id", s.Parent)
+		}
+		for k, v := range s.Attributes {
+			args = append(args, k, v)
+		}
+		if s.Err != "" {
+			args = append(args, "err", s.Err)
+		}
+		l.Info("span "+s.Name, args...)
+	})
+}
+
+// Tracer starts spans for an Exporter
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a tracer recording to e; a nil e records nothing
+func NewTracer(e Exporter) *Tracer {
+	return &Tracer{exporter: e}
+}
+
+// Start begins a span as a child of the span context in ctx (a new trace if there is
+// none) and returns ctx carrying the new span's context. Without an exporter, or if
+// the parent is not sampled, it returns ctx unchanged and a nil span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanContextFromContext(ctx)
+	if t == nil || t.exporter == nil || parent.IsValid() && !parent.Sampled() {
+		return ctx, nil
+	}
+	s := &Span{Name: name, Kind: kind, StartTime: time.Now(), exporter: t.exporter}
+	if parent.IsValid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Flags = parent.Flags
+		s.Parent = parent.SpanID
+	} else {
+		s.Context.TraceID = newTraceID()
+		s.Context.Flags = FlagSampled
+	}
+	s.Context.SpanID = newSpanID()
+	return ContextWithSpanContext(ctx, s.Context), s
+}
+
+func newTraceID() (id TraceID) {
+	for id == (TraceID{}) {
+		binary.LittleEndian.PutUint64(id[:8], rand.Uint64())
+		binary.LittleEndian.PutUint64(id[8:], rand.Uint64())
+	}
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	for id == (SpanID{}) {
+		binary.LittleEndian.PutUint64(id[:], rand.Uint64())
+	}
+	return id
+}
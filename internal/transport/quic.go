@@ -7,20 +7,27 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"io"
 	"math/big"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/SWAI-Ltd/Qumbed/internal/proto"
 	"github.com/quic-go/quic-go"
 )
 
-// Default idle timeout: 5 minutes (QUIC default is 30s, too short for pub/sub)
+// Client idle timeout: 1 minute, with keep-alives so quiet subscribers stay connected.
+// QUIC uses the lower of both peers' timeouts, so this bounds how long a crashed
+// client goes unnoticed (e.g. before the relay publishes its will).
 var defaultQuicConfig = &quic.Config{
-	MaxIdleTimeout: 5 * time.Minute,
+	MaxIdleTimeout:  time.Minute,
+	KeepAlivePeriod: 15 * time.Second,
 }
 
-// Server QUIC config: same as client + Allow0RTT for session resumption (0-RTT).
+// Server QUIC config: 5-minute idle timeout, so clients without keep-alives are not
+// dropped sooner than before, + Allow0RTT for session resumption (0-RTT).
 var serverQuicConfig = &quic.Config{
 	MaxIdleTimeout: 5 * time.Minute,
 	Allow0RTT:      true,
@@ -38,10 +45,15 @@ const (
 	ProtoID   = "qumbed/1"
 )
 
-// Conn wraps a QUIC connection with frame read/write
+// Conn wraps a QUIC connection with frame read/write. SendFrame may be called from
+// several goroutines; frames are written whole, one at a time.
 type Conn struct {
 	Stream quic.Stream
 	Conn   quic.Connection
+
+	wmu sync.Mutex // serializes frame writes so concurrent frames do not interleave
+
+	sent, received atomic.Uint64 // frame bytes, including length prefixes
 }
 
 // NewConn wraps a QUIC stream and connection
@@ -62,14 +74,47 @@ func (c *Conn) RemoteAddr() string {
 	return "unknown"
 }
 
-// SendFrame encodes and sends a frame
+// PeerCertificates returns the certificates the peer presented in the TLS handshake
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.ConnectionState().TLS.PeerCertificates
+}
+
+// SendFrame encodes and sends a frame; safe for concurrent use
 func (c *Conn) SendFrame(f *proto.Frame) error {
-	return f.Encode(c.Stream)
+	buf, err := f.Marshal()
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n, err := c.Stream.Write(buf)
+	c.sent.Add(uint64(n))
+	return err
 }
 
 // RecvFrame reads and decodes a frame
 func (c *Conn) RecvFrame(f *proto.Frame) error {
-	return f.Decode(c.Stream)
+	return f.Decode(countingReader{c.Stream, &c.received})
+}
+
+// BytesSent returns the number of frame bytes written to the connection
+func (c *Conn) BytesSent() uint64 { return c.sent.Load() }
+
+// BytesReceived returns the number of frame bytes read from the connection
+func (c *Conn) BytesReceived() uint64 { return c.received.Load() }
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Uint64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(uint64(n))
+	return n, err
 }
 
 // Close closes the stream and the QUIC connection (if set) to avoid leaks.
@@ -106,6 +151,7 @@ func generateTLSConfig() (*tls.Config, error) {
 	return &tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
 		NextProtos:   []string{ProtoID},
+		ClientAuth:   tls.RequestClientCert, // verified by the relay's Authenticator, if any
 	}, nil
 }
 
@@ -113,8 +159,13 @@ func generateTLSConfig() (*tls.Config, error) {
 type Server struct {
 	Listener *quic.EarlyListener
 	Handler  func(*Conn)
+
+	refusing atomic.Bool // set by StopAccepting
 }
 
+// refusedCode is the QUIC application error code of connections refused by StopAccepting
+const refusedCode quic.ApplicationErrorCode = 1
+
 // ListenQUIC starts a QUIC server on addr. Pass handler to avoid races.
 func ListenQUIC(ctx context.Context, addr string) (*Server, error) {
 	return ListenQUICWithHandler(ctx, addr, nil)
@@ -123,9 +174,20 @@ func ListenQUIC(ctx context.Context, addr string) (*Server, error) {
 // ListenQUICWithHandler starts a QUIC server with handler set before accepting.
 // Uses ListenAddrEarly and Allow0RTT so returning clients can send data in the first packet (0-RTT).
 func ListenQUICWithHandler(ctx context.Context, addr string, handler func(*Conn)) (*Server, error) {
-	tlsCfg, err := generateTLSConfig()
-	if err != nil {
-		return nil, err
+	return ListenQUICWithTLS(ctx, addr, nil, handler)
+}
+
+// ListenQUICWithTLS is ListenQUICWithHandler with the server's TLS config (certificate,
+// client certificate policy); nil uses a self-signed development certificate.
+func ListenQUICWithTLS(ctx context.Context, addr string, tlsCfg *tls.Config, handler func(*Conn)) (*Server, error) {
+	if tlsCfg == nil {
+		var err error
+		if tlsCfg, err = generateTLSConfig(); err != nil {
+			return nil, err
+		}
+	} else {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.NextProtos = []string{ProtoID}
 	}
 	listener, err := quic.ListenAddrEarly(addr, tlsCfg, serverQuicConfig)
 	if err != nil {
@@ -140,11 +202,15 @@ func (s *Server) acceptLoop(ctx context.Context) {
 	for {
 		sess, err := s.Listener.Accept(ctx)
 		if err != nil {
-			if ctx.Err() != nil {
+			if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
 				return
 			}
 			continue
 		}
+		if s.refusing.Load() {
+			sess.CloseWithError(refusedCode, "server shutting down")
+			continue
+		}
 		go func() {
 			stream, err := sess.AcceptStream(ctx)
 			if err != nil {
@@ -163,10 +229,20 @@ func (s *Server) acceptLoop(ctx context.Context) {
 // Uses DialAddrEarly and a shared ClientSessionCache so returning devices can send data
 // in the first packet (0-RTT), reducing handshake latency from ~2 RTTs to ~0 RTT.
 func DialQUIC(ctx context.Context, addr string) (*Conn, error) {
-	tlsCfg := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{ProtoID},
-		ClientSessionCache:  defaultClientSessionCache,
+	return DialQUICWithTLS(ctx, addr, nil)
+}
+
+// DialQUICWithTLS is DialQUIC with the client's TLS config (client certificate, RootCAs
+// to verify the relay); nil skips verification as DialQUIC does.
+func DialQUICWithTLS(ctx context.Context, addr string, tlsCfg *tls.Config) (*Conn, error) {
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{InsecureSkipVerify: true}
+	} else {
+		tlsCfg = tlsCfg.Clone()
+	}
+	tlsCfg.NextProtos = []string{ProtoID}
+	if tlsCfg.ClientSessionCache == nil {
+		tlsCfg.ClientSessionCache = defaultClientSessionCache
 	}
 	sess, err := quic.DialAddrEarly(ctx, addr, tlsCfg, defaultQuicConfig)
 	if err != nil {
@@ -180,6 +256,18 @@ func DialQUIC(ctx context.Context, addr string) (*Conn, error) {
 	return NewConnWithConn(stream, sess), nil
 }
 
+// StopAccepting refuses new connections while the open ones keep working (closing the
+// listener would close them too)
+func (s *Server) StopAccepting() {
+	s.refusing.Store(true)
+}
+
+// Close closes the listener and with it every connection it accepted
+func (s *Server) Close() error {
+	s.refusing.Store(true)
+	return s.Listener.Close()
+}
+
 // LocalAddr returns the address of the QUIC listener
 func (s *Server) LocalAddr() string {
 	return s.Listener.Addr().String()